@@ -2,10 +2,10 @@ package deskconn
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/xconnio/wampproto-go/auth"
 	"github.com/xconnio/xconn-go"
@@ -14,9 +14,16 @@ import (
 const (
 	Realm                          = "io.xconn.deskconn"
 	ProcedureDeskconnAttachDesktop = "io.xconn.deskconn.desktop.attach"
+	ProcedureDeskconnDetachDesktop = "io.xconn.deskconn.desktop.detach"
+	ProcedureDeskconnRotateKey     = "io.xconn.deskconn.desktop.key.rotate"
 	MachineIDPath                  = "/etc/machine-id"
+
+	// KeyMaxAge is how long a key pair may be used before it must be rotated.
+	KeyMaxAge = 90 * 24 * time.Hour
 )
 
+// CloudURI returns the URI of the cloud router of the default profile when it
+// does not set one.
 func CloudURI() string {
 	if v, ok := os.LookupEnv("DESKCONN_CLOUD_URI"); ok {
 		return v
@@ -27,15 +34,39 @@ func CloudURI() string {
 type Credentials struct {
 	AuthID     string `json:"auth_id"`
 	PublicKey  string `json:"public_key"`
-	PrivateKey string `json:"private_key"`
+	PrivateKey string `json:"private_key,omitempty"`
+	// CreatedAt is when the key pair was generated, unknown for credentials
+	// written before it was recorded.
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	// KeyStorage is where the private key is kept when it is not in the file
+	// in plaintext. EncryptedKey holds it for KeyStoragePassphrase.
+	KeyStorage   KeyStorage    `json:"key_storage,omitempty"`
+	EncryptedKey *EncryptedKey `json:"encrypted_private_key,omitempty"`
+}
+
+// KeyExpired reports whether the key pair is due for rotation.
+func (c *Credentials) KeyExpired() bool {
+	return !c.CreatedAt.IsZero() && time.Since(c.CreatedAt) > KeyMaxAge
 }
 
-func Attach(ctx context.Context, username, password, desktopName string) error {
-	session, err := xconn.ConnectCRA(ctx, CloudURI(), Realm, username, password)
+func Attach(ctx context.Context, profileName, username, password, desktopName string) error {
+	profile, err := LoadProfile(profileName)
+	if err != nil {
+		return err
+	}
+
+	session, err := profile.ConnectCRA(ctx, username, password)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = session.Leave() }()
 
+	return attachDesktop(profile, session, desktopName, nil)
+}
+
+// attachDesktop registers a new key pair for the machine with the cloud and
+// stores it as the credentials of the desktop in the profile.
+func attachDesktop(profile *Profile, session *xconn.Session, desktopName string, kwargs map[string]any) error {
 	machineID, err := os.ReadFile(MachineIDPath)
 	if err != nil {
 		return fmt.Errorf("failed to read machine-id: %w", err)
@@ -47,30 +78,168 @@ func Attach(ctx context.Context, username, password, desktopName string) error {
 		return fmt.Errorf("failed to generate cryptosign keypair: %w", err)
 	}
 
-	callResp := session.Call(ProcedureDeskconnAttachDesktop).Args(machineIDStr, publicKey).Kwarg("name", desktopName).Do()
+	callResp := session.Call(ProcedureDeskconnAttachDesktop).Args(machineIDStr, publicKey).
+		Kwargs(mergeKwargs(map[string]any{"name": desktopName}, kwargs)).Do()
 	if callResp.Err != nil {
 		return fmt.Errorf("failed to attach desktop: %w", callResp.Err)
 	}
 
-	return writeCredentialsFile(machineIDStr, publicKey, privateKey)
+	attached, err := profile.withCredentials(&Credentials{
+		AuthID:     machineIDStr,
+		PublicKey:  publicKey,
+		PrivateKey: privateKey,
+		CreatedAt:  time.Now().UTC(),
+	}, "")
+	if err != nil {
+		return err
+	}
+	return SaveProfile(attached)
+}
+
+// Detach revokes the desktop from the cloud of the profile using its stored
+// identity and then removes the credentials, which makes a running deskconnd
+// leave that cloud.
+func Detach(ctx context.Context, profileName string, opts KeyOptions) error {
+	profile, session, creds, err := connectWithCredentials(ctx, profileName, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Leave() }()
+
+	callResp := session.Call(ProcedureDeskconnDetachDesktop).Args(creds.AuthID).Do()
+	if callResp.Err != nil {
+		return fmt.Errorf("failed to detach desktop: %w", callResp.Err)
+	}
+
+	detached, err := profile.withCredentials(nil, "")
+	if err != nil {
+		return err
+	}
+	if err := SaveProfile(detached); err != nil {
+		return err
+	}
+	return forgetPrivateKey(creds)
 }
 
-func writeCredentialsFile(machineID, publicKey, privateKey string) error {
-	credFilePath, err := credentialsFilePath()
+// RotateKey replaces the key pair of the desktop in the profile. The cloud
+// accepts the new public key over a session authenticated with the old key,
+// and only then are the stored credentials swapped, which makes a running
+// deskconnd reconnect with the new key.
+func RotateKey(ctx context.Context, profileName string, opts KeyOptions) error {
+	profile, session, creds, err := connectWithCredentials(ctx, profileName, opts)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = session.Leave() }()
 
-	creds := Credentials{
-		AuthID:     machineID,
+	publicKey, privateKey, err := auth.GenerateCryptoSignKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate cryptosign keypair: %w", err)
+	}
+
+	passphrase, err := storagePassphrase(creds.KeyStorage, opts)
+	if err != nil {
+		return err
+	}
+
+	// The new key is stored before the cloud knows about it, so it cannot be
+	// lost once the old key is revoked. It is kept where the old one was.
+	rotated := Credentials{
+		AuthID:     creds.AuthID,
 		PublicKey:  publicKey,
 		PrivateKey: privateKey,
+		CreatedAt:  time.Now().UTC(),
+		KeyStorage: creds.KeyStorage,
+	}
+	updated, err := profile.withCredentials(&rotated, passphrase)
+	if err != nil {
+		return err
+	}
+	staged, err := stageProfile(updated)
+	if err != nil {
+		_ = forgetPrivateKey(&rotated)
+		return err
+	}
+
+	callResp := session.Call(ProcedureDeskconnRotateKey).Args(creds.AuthID, publicKey).Do()
+	if callResp.Err != nil {
+		_ = os.Remove(staged)
+		_ = forgetPrivateKey(&rotated)
+		return fmt.Errorf("failed to rotate key: %w", callResp.Err)
+	}
+
+	if err := commitProfile(updated, staged); err != nil {
+		return err
+	}
+	return forgetPrivateKey(creds)
+}
+
+// MigrateKey moves the private key of the desktop in the profile to another
+// key storage, encrypting it with the given passphrase for
+// KeyStoragePassphrase. Migrating to the passphrase storage again changes the
+// passphrase. opts unlock the key where it is kept now.
+func MigrateKey(profileName string, storage KeyStorage, passphrase string, opts KeyOptions) error {
+	profile, creds, err := loadCredentials(profileName, opts)
+	if err != nil {
+		return err
+	}
+
+	migrated := *creds
+	migrated.KeyStorage = storage
+	updated, err := profile.withCredentials(&migrated, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := SaveProfile(updated); err != nil {
+		return err
+	}
+
+	if creds.KeyStorage != storage {
+		return forgetPrivateKey(creds)
 	}
+	return nil
+}
 
-	data, err := json.MarshalIndent(creds, "", "  ")
+// connectWithCredentials logs in to the cloud of the profile with the stored
+// identity of the desktop.
+func connectWithCredentials(ctx context.Context, profileName string, opts KeyOptions) (*Profile, *xconn.Session,
+	*Credentials, error) {
+	profile, creds, err := loadCredentials(profileName, opts)
 	if err != nil {
-		return fmt.Errorf("failed to marshal credentials: %w", err)
+		return nil, nil, nil, err
 	}
 
-	return os.WriteFile(credFilePath, data, 0600)
+	session, err := profile.ConnectCryptosign(ctx, creds)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to connect to cloud: %w", err)
+	}
+
+	return profile, session, creds, nil
+}
+
+// loadCredentials reads a profile along with the credentials of the desktop
+// in it, their private key unlocked.
+func loadCredentials(profileName string, opts KeyOptions) (*Profile, *Credentials, error) {
+	profile, err := LoadProfile(profileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if profile.Credentials == nil {
+		return nil, nil, fmt.Errorf("desktop is not attached to profile %s", profileName)
+	}
+
+	creds := *profile.Credentials
+	if err := unlockPrivateKey(&creds, opts); err != nil {
+		return nil, nil, err
+	}
+	return profile, &creds, nil
+}
+
+// storagePassphrase returns the passphrase to store a private key with, if
+// the storage needs one.
+func storagePassphrase(storage KeyStorage, opts KeyOptions) (string, error) {
+	if storage != KeyStoragePassphrase {
+		return "", nil
+	}
+	return opts.passphrase()
 }
@@ -0,0 +1,132 @@
+package deskconn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var BacklightBasePath = "/sys/class/backlight" //nolint: gochecknoglobals
+
+var errBacklightNotFound = errors.New("backlight device not found")
+
+// brightnessDebounce coalesces the burst of sysfs notifications a single
+// brightness key press produces into one change event.
+const brightnessDebounce = 150 * time.Millisecond
+
+// fadeInterval is the delay between two steps of an animated brightness change.
+const fadeInterval = 20 * time.Millisecond
+
+// BacklightDevice describes a backlight found under BacklightBasePath.
+type BacklightDevice struct {
+	Name          string
+	Type          string
+	MaxBrightness int
+	Brightness    int
+	Default       bool
+}
+
+type backlight struct {
+	name string
+	typ  string
+	dir  string
+	max  int
+
+	// last percentage reported to brightness handlers, guarded by Screen.mu
+	percent  int
+	debounce *time.Timer
+
+	// generation of the most recent brightness change, so a running fade
+	// notices it has been superseded
+	fade uint64
+	mu   sync.Mutex
+}
+
+// backlightPriority ranks backlight types the same way the kernel and
+// userspace tools do when picking a panel: firmware interfaces first, then
+// platform drivers, then raw GPU registers.
+func backlightPriority(typ string) int {
+	switch typ {
+	case "firmware":
+		return 0
+	case "platform":
+		return 1
+	case "raw":
+		return 2
+	default:
+		return 3
+	}
+}
+
+func findBacklights(base string) []*backlight {
+	var backlights []*backlight
+
+	entries, _ := os.ReadDir(base)
+	for _, e := range entries {
+		full := filepath.Join(base, e.Name())
+		info, err := os.Stat(full)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		max, err := readSysfsInt(filepath.Join(full, "max_brightness"))
+		if err != nil {
+			continue
+		}
+
+		typ, _ := os.ReadFile(filepath.Join(full, "type"))
+
+		backlights = append(backlights, &backlight{
+			name: e.Name(),
+			typ:  strings.TrimSpace(string(typ)),
+			dir:  full,
+			max:  max,
+		})
+	}
+
+	sort.SliceStable(backlights, func(i, j int) bool {
+		return backlightPriority(backlights[i].typ) < backlightPriority(backlights[j].typ)
+	})
+
+	return backlights
+}
+
+func (b *backlight) brightnessPath() string {
+	return filepath.Join(b.dir, "brightness")
+}
+
+func (b *backlight) actualBrightnessPath() string {
+	return filepath.Join(b.dir, "actual_brightness")
+}
+
+func (b *backlight) toPercent(value int) int {
+	if b.max <= 0 {
+		return 0
+	}
+
+	return (value * 100) / b.max
+}
+
+func (b *backlight) current() (int, error) {
+	return readSysfsInt(b.brightnessPath())
+}
+
+func readSysfsInt(path string) (int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %w", path, err)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,125 @@
+package deskconn
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	BrightnessBackendLogind  = "logind"
+	BrightnessBackendSysfs   = "sysfs"
+	BrightnessBackendCommand = "command"
+)
+
+// BrightnessBackend writes raw brightness values to a backlight device.
+type BrightnessBackend interface {
+	Name() string
+	SetBrightness(device string, value int) error
+}
+
+type logindBrightnessBackend struct {
+	systemBus *dbus.Conn
+}
+
+// NewLogindBrightnessBackend changes brightness through the logind session,
+// which works unprivileged for the user owning the active session.
+func NewLogindBrightnessBackend(systemBus *dbus.Conn) BrightnessBackend {
+	return &logindBrightnessBackend{systemBus: systemBus}
+}
+
+func (l *logindBrightnessBackend) Name() string {
+	return BrightnessBackendLogind
+}
+
+func (l *logindBrightnessBackend) SetBrightness(device string, value int) error {
+	obj := l.systemBus.Object(logindService, logindAutoSession)
+
+	return obj.Call(logindSessionIface+".SetBrightness", 0, "backlight", device,
+		uint32(value)).Err // #nosec G115
+}
+
+// logindAvailable reports whether logind is reachable on the system bus.
+func logindAvailable(systemBus *dbus.Conn) bool {
+	if systemBus == nil {
+		return false
+	}
+
+	obj := systemBus.Object(logindService, logindManagerPath)
+	return obj.Call("org.freedesktop.DBus.Peer.Ping", 0).Err == nil
+}
+
+type sysfsBrightnessBackend struct {
+	basePath string
+}
+
+// NewSysfsBrightnessBackend writes straight to the brightness file of the
+// device under basePath, which requires deskconnd to run with write access.
+func NewSysfsBrightnessBackend(basePath string) BrightnessBackend {
+	return &sysfsBrightnessBackend{basePath: basePath}
+}
+
+func (s *sysfsBrightnessBackend) Name() string {
+	return BrightnessBackendSysfs
+}
+
+func (s *sysfsBrightnessBackend) SetBrightness(device string, value int) error {
+	path := filepath.Join(s.basePath, device, "brightness")
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteString(strconv.Itoa(value)); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// sysfsWritable reports whether the brightness file of device can be opened
+// for writing.
+func sysfsWritable(basePath, device string) bool {
+	file, err := os.OpenFile(filepath.Join(basePath, device, "brightness"), os.O_WRONLY, 0)
+	if err != nil {
+		return false
+	}
+
+	_ = file.Close()
+	return true
+}
+
+type commandBrightnessBackend struct {
+	command []string
+}
+
+// NewCommandBrightnessBackend runs command with the device name and raw
+// value appended as arguments, e.g. "sudo /usr/local/bin/set-backlight".
+func NewCommandBrightnessBackend(command string) BrightnessBackend {
+	return &commandBrightnessBackend{command: strings.Fields(command)}
+}
+
+func (c *commandBrightnessBackend) Name() string {
+	return BrightnessBackendCommand
+}
+
+func (c *commandBrightnessBackend) SetBrightness(device string, value int) error {
+	if len(c.command) == 0 {
+		return fmt.Errorf("brightness helper command not configured")
+	}
+
+	args := append(append([]string{}, c.command[1:]...), device, strconv.Itoa(value))
+	output, err := exec.Command(c.command[0], args...).CombinedOutput() // #nosec G204
+	if err != nil {
+		return fmt.Errorf("brightness helper failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
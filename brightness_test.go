@@ -0,0 +1,86 @@
+package deskconn_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+func TestSysfsBrightnessBackend(t *testing.T) {
+	tmp := mockBacklightDir(t)
+
+	backend := deskconn.NewSysfsBrightnessBackend(tmp)
+	require.Equal(t, deskconn.BrightnessBackendSysfs, backend.Name())
+	require.NoError(t, backend.SetBrightness("intel_backlight", 42))
+
+	raw, err := os.ReadFile(filepath.Join(tmp, "intel_backlight", "brightness"))
+	require.NoError(t, err)
+	require.Equal(t, "42", string(raw))
+
+	require.Error(t, backend.SetBrightness("missing", 42))
+}
+
+func TestCommandBrightnessBackend(t *testing.T) {
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "out")
+	script := filepath.Join(tmp, "helper.sh")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0700)
+	require.NoError(t, err)
+
+	backend := deskconn.NewCommandBrightnessBackend(script + " --raw")
+	require.Equal(t, deskconn.BrightnessBackendCommand, backend.Name())
+	require.NoError(t, backend.SetBrightness("intel_backlight", 7))
+
+	raw, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "--raw intel_backlight 7\n", string(raw))
+
+	failing := deskconn.NewCommandBrightnessBackend("false")
+	require.ErrorContains(t, failing.SetBrightness("intel_backlight", 7), "brightness helper failed")
+}
+
+func TestLogindBrightnessBackend(t *testing.T) {
+	tmp := mockBacklightDir(t)
+	address := startPrivateBus(t)
+	logind := exportFakeLogind(t, connectPrivateBus(t, address), tmp)
+
+	backend := deskconn.NewLogindBrightnessBackend(connectPrivateBus(t, address))
+	require.Equal(t, deskconn.BrightnessBackendLogind, backend.Name())
+	require.NoError(t, backend.SetBrightness("intel_backlight", 30))
+	require.Equal(t, []uint32{30}, logind.Values())
+}
+
+func TestBrightnessBackendDetection(t *testing.T) {
+	tmp := mockBacklightDir(t)
+	address := startPrivateBus(t)
+
+	// without logind on the bus a writable sysfs file is used directly
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = s.Close() })
+
+	info, err := s.BrightnessInfo()
+	require.NoError(t, err)
+	require.Equal(t, deskconn.BrightnessInfo{Backend: deskconn.BrightnessBackendSysfs, Device: "intel_backlight"}, info)
+
+	require.NoError(t, s.SetBrightness(80))
+	brightness, err := s.GetBrightness()
+	require.NoError(t, err)
+	require.Equal(t, 80, brightness)
+
+	exportFakeLogind(t, connectPrivateBus(t, address), tmp)
+	s = deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = s.Close() })
+
+	info, err = s.BrightnessInfo()
+	require.NoError(t, err)
+	require.Equal(t, deskconn.BrightnessBackendLogind, info.Backend)
+
+	s.SetBrightnessBackend(deskconn.NewCommandBrightnessBackend("true"))
+	info, err = s.BrightnessInfo()
+	require.NoError(t, err)
+	require.Equal(t, deskconn.BrightnessBackendCommand, info.Backend)
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -26,10 +29,52 @@ func main() {
 		if err := attach(os.Args[2:]); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
+	case "pair":
+		if err := pair(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "detach":
+		if err := withKeyPassphrase(os.Args[2:], detach); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "rotate-key":
+		if err := withKeyPassphrase(os.Args[2:], rotateKey); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "migrate-key":
+		if err := withKeyPassphrase(os.Args[2:], migrateKey); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "profile":
+		if err := profile(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "profiles":
+		if err := listProfiles(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	case "shell":
 		if err := shell(os.Args[2:]); err != nil {
+			var exitErr *deskconn.ShellExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.Code)
+			}
 			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+	case "exec":
+		code, err := execCommand(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(code)
 	default:
 		usage()
 		os.Exit(1)
@@ -43,14 +88,11 @@ func attach(args []string) error {
 
 	name := fs.String("name", "", "")
 	fs.StringVar(name, "n", "", "")
+	code := fs.String("code", "", "attach with a pairing code instead of the account password")
+	profileName := profileFlag(fs)
 
 	_ = fs.Parse(args)
 
-	username, err := parseUsername(fs.Args())
-	if err != nil {
-		return err
-	}
-
 	deviceName := *name
 	if deviceName == "" {
 		host, err := os.Hostname()
@@ -60,18 +102,32 @@ func attach(args []string) error {
 		deviceName = host
 	}
 
+	if *code != "" {
+		if fs.NArg() != 0 || useStdin {
+			return fmt.Errorf("--code takes neither a username nor a password")
+		}
+		return deskconn.AttachWithCode(context.Background(), *profileName, *code, deviceName)
+	}
+
+	username, err := parseUsername(fs.Args())
+	if err != nil {
+		return err
+	}
+
 	password, err := readPassword(useStdin)
 	if err != nil {
 		return err
 	}
 
-	return deskconn.Attach(context.Background(), username, password, deviceName)
+	return deskconn.Attach(context.Background(), *profileName, username, password, deviceName)
 }
 
-func shell(args []string) error {
+func pair(args []string) error {
 	useStdin, args := extractPasswordStdin(args)
 
-	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	ttl := fs.Duration("ttl", deskconn.DefaultPairingCodeTTL, "how long the code stays valid")
+	profileName := profileFlag(fs)
 	_ = fs.Parse(args)
 
 	username, err := parseUsername(fs.Args())
@@ -84,35 +140,361 @@ func shell(args []string) error {
 		return err
 	}
 
-	session, err := xconn.ConnectCRA(context.Background(), deskconn.CloudURI(), deskconn.Realm, username, password)
+	session, err := connectAccount(*profileName, username, password)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = session.Leave() }()
+
+	code, err := deskconn.CreatePairingCode(session, *ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pairing code: %s (valid until %s)\n", code.Code, code.ExpiresAt.Local().Format("2006-01-02 15:04 MST"))
+	if *profileName == deskconn.DefaultProfile {
+		fmt.Printf("On the desktop, run: deskconnctl attach --code %s\n", code.Code)
+	} else {
+		fmt.Printf("On the desktop, run: deskconnctl attach --profile %s --code %s\n", *profileName, code.Code)
+	}
+	return nil
+}
+
+func detach(args []string, opts deskconn.KeyOptions) error {
+	fs := flag.NewFlagSet("detach", flag.ExitOnError)
+	profileName := profileFlag(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("detach takes no arguments")
+	}
+
+	if err := deskconn.Detach(context.Background(), *profileName, opts); err != nil {
+		return err
+	}
+
+	fmt.Println("Desktop detached from cloud")
+	return nil
+}
+
+func rotateKey(args []string, opts deskconn.KeyOptions) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	profileName := profileFlag(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("rotate-key takes no arguments")
+	}
+
+	if err := deskconn.RotateKey(context.Background(), *profileName, opts); err != nil {
+		return err
+	}
+
+	fmt.Println("Desktop key rotated")
+	return nil
+}
+
+func migrateKey(args []string, opts deskconn.KeyOptions) error {
+	fs := flag.NewFlagSet("migrate-key", flag.ExitOnError)
+	to := fs.String("to", "", "where to keep the private key: plain, passphrase or secret-service")
+	passphraseStdin := fs.Bool("passphrase-stdin", false, "read the new passphrase from stdin")
+	profileName := profileFlag(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("migrate-key takes no arguments")
+	}
+
+	storage, err := deskconn.ParseKeyStorage(*to)
+	if err != nil {
+		return err
+	}
+
+	var passphrase string
+	if storage == deskconn.KeyStoragePassphrase {
+		passphrase, err = readNewPassphrase(*passphraseStdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := deskconn.MigrateKey(*profileName, storage, passphrase, opts); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key moved to %s storage\n", storage)
+	return nil
+}
+
+func profile(args []string) error {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	profileName := profileFlag(fs)
+	uri := fs.String("uri", "", "set the URI of the cloud router")
+	realm := fs.String("realm", "", "set the realm on the cloud router")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("profile takes no arguments")
+	}
+
+	p, err := deskconn.LoadProfile(*profileName)
+	if err != nil {
+		return err
+	}
+
+	if *uri != "" || *realm != "" {
+		if *uri != "" {
+			p.URI = *uri
+		}
+		if *realm != "" {
+			p.Realm = *realm
+		}
+		if err := deskconn.SaveProfile(p); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Profile: %s\n", p.Name)
+	fmt.Printf("URI:     %s\n", valueOr(p.URI, "(default)"))
+	fmt.Printf("Realm:   %s\n", valueOr(p.Realm, deskconn.Realm))
+	if p.Credentials == nil {
+		fmt.Println("Desktop: not attached")
+		return nil
+	}
+	fmt.Printf("Desktop: attached as %s, key in %s storage\n", p.Credentials.AuthID,
+		valueOr(string(p.Credentials.KeyStorage), string(deskconn.KeyStoragePlain)))
+	return nil
+}
+
+func listProfiles(args []string) error {
+	fs := flag.NewFlagSet("profiles", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("profiles takes no arguments")
+	}
+
+	names, err := deskconn.ListProfiles()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		p, err := deskconn.LoadProfile(name)
+		if err != nil {
+			return err
+		}
+		state := "not attached"
+		if p.Credentials != nil {
+			state = "attached"
+		}
+		fmt.Printf("%-16s %-40s %s\n", name, valueOr(p.URI, "(default)"), state)
+	}
+	return nil
+}
+
+// profileFlag adds --profile to the flags of a command, naming the cloud
+// profile it works with. DESKCONN_PROFILE changes the default.
+func profileFlag(fs *flag.FlagSet) *string {
+	return fs.String("profile", valueOr(os.Getenv("DESKCONN_PROFILE"), deskconn.DefaultProfile),
+		"cloud profile to use")
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// withKeyPassphrase runs a command that uses the stored private key, asking
+// for its passphrase and running it again if the key is encrypted. The
+// passphrase is handed to the command only, never to child processes.
+func withKeyPassphrase(args []string, command func([]string, deskconn.KeyOptions) error) error {
+	err := command(args, deskconn.KeyOptions{})
+	if !errors.Is(err, deskconn.ErrPassphraseRequired) || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return err
+	}
+
+	passphrase, err := promptSecret("Key passphrase: ")
+	if err != nil {
+		return err
+	}
+	return command(args, deskconn.KeyOptions{Passphrase: passphrase})
+}
+
+func readNewPassphrase(fromStdin bool) (string, error) {
+	if fromStdin {
+		return readPassword(true)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("passphrase required from TTY or use --passphrase-stdin")
+	}
+
+	passphrase, err := promptSecret("New key passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	repeated, err := promptSecret("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != repeated {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+func shell(args []string) error {
+	useStdin, args := extractPasswordStdin(args)
+
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	resume := fs.String("resume", "", "resume a detached shell by its id")
+	watch := fs.String("watch", "", "follow the output of a shell attached elsewhere, by its id")
+	write := fs.Bool("write", false, "with --watch, type into the shell as well, if its owner allows it")
+	var options deskconn.ShellOptions
+	fs.StringVar(&options.Command, "command", "", "program to run instead of the default shell")
+	fs.BoolVar(&options.Login, "login", false, "start a login shell")
+	fs.StringVar(&options.Dir, "cwd", "", "starting directory")
+	fs.BoolVar(&options.ShareWrite, "share-write", false, "let watchers of the shell type into it")
+	profileName := profileFlag(fs)
+	fs.Func("env", "extra environment variable as KEY=VALUE, may be repeated", func(value string) error {
+		name, val, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected KEY=VALUE, got %q", value)
+		}
+		if options.Env == nil {
+			options.Env = map[string]string{}
+		}
+		options.Env[name] = val
+		return nil
+	})
+	_ = fs.Parse(args)
+
+	username, err := parseUsername(fs.Args())
+	if err != nil {
+		return err
+	}
+	if *write && *watch == "" {
+		return fmt.Errorf("--write requires --watch")
+	}
+
+	session, machineID, err := connectDesktop(*profileName, username, useStdin)
+	if err != nil {
+		return err
+	}
+
+	if *watch != "" {
+		return deskconn.WatchInteractiveShell(session, fmt.Sprintf(deskconn.ProcedureShellWatchCloud, machineID),
+			*watch, *write)
+	}
+
+	if *resume != "" {
+		return deskconn.ResumeInteractiveShell(session, fmt.Sprintf(deskconn.ProcedureShellAttachCloud, machineID),
+			*resume)
+	}
+
+	return deskconn.StartInteractiveShellWithOptions(session, fmt.Sprintf(deskconn.ProcedureShellCloud, machineID),
+		options)
+}
+
+func execCommand(args []string) (int, error) {
+	var command []string
+	if i := slices.Index(args, "--"); i >= 0 {
+		args, command = args[:i], args[i+1:]
+	}
+	useStdin, args := extractPasswordStdin(args)
+
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	var options deskconn.ExecOptions
+	fs.DurationVar(&options.Timeout, "timeout", 0, "kill the command after this long")
+	fs.StringVar(&options.Dir, "cwd", "", "directory to run the command in")
+	forwardStdin := fs.Bool("stdin", false, "send local stdin to the command")
+	profileName := profileFlag(fs)
+	_ = fs.Parse(args)
+
+	username, err := parseUsername(fs.Args())
+	if err != nil {
+		return 0, err
+	}
+	if len(command) == 0 {
+		return 0, fmt.Errorf("requires a command after --")
+	}
+
+	if *forwardStdin {
+		if useStdin {
+			return 0, fmt.Errorf("--stdin cannot be combined with --password-stdin")
+		}
+		options.Stdin, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	session, machineID, err := connectDesktop(*profileName, username, useStdin)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := deskconn.Exec(session, fmt.Sprintf(deskconn.ProcedureExecCloud, machineID), command, options,
+		os.Stdout, os.Stderr)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case result.TimedOut:
+		fmt.Fprintf(os.Stderr, "command timed out after %v\n", options.Timeout)
+	case result.Signal != "":
+		fmt.Fprintf(os.Stderr, "command terminated by signal: %s\n", result.Signal)
+	}
+	if result.ExitCode < 0 {
+		return 1, nil
+	}
+	return result.ExitCode, nil
+}
+
+// connectAccount logs in to the cloud of a profile as an account.
+func connectAccount(profileName, username, password string) (*xconn.Session, error) {
+	p, err := deskconn.LoadProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	return p.ConnectCRA(context.Background(), username, password)
+}
+
+// connectDesktop logs in to the cloud of a profile and lets the user pick one
+// of the desktops attached to the account, returning its machine id.
+func connectDesktop(profileName, username string, useStdin bool) (*xconn.Session, string, error) {
+	password, err := readPassword(useStdin)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session, err := connectAccount(profileName, username, password)
+	if err != nil {
+		return nil, "", err
+	}
 
 	callResp := session.Call("io.xconn.deskconn.desktop.list").Do()
 	if callResp.Err != nil {
-		return callResp.Err
+		return nil, "", callResp.Err
 	}
 	if len(callResp.Args()) == 0 {
-		return fmt.Errorf("no desktop attached to the account")
+		return nil, "", fmt.Errorf("no desktop attached to the account")
 	}
 
 	idx, err := selectDevice(callResp)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	deviceDict, err := callResp.ArgDict(idx)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	machineID, err := deviceDict.String("authid")
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	return deskconn.StartInteractiveShell(session, fmt.Sprintf(deskconn.ProcedureShellCloud, machineID))
+	return session, machineID, nil
 }
 
 func extractPasswordStdin(args []string) (bool, []string) {
@@ -154,14 +536,18 @@ func readPassword(fromStdin bool) (string, error) {
 		return "", fmt.Errorf("password required from TTY or use --password-stdin")
 	}
 
-	fmt.Fprint(os.Stderr, "Password: ")
-	pwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+	return promptSecret("Password: ")
+}
+
+func promptSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
 	fmt.Fprintln(os.Stderr)
 	if err != nil {
 		return "", err
 	}
 
-	return string(pwd), nil
+	return string(secret), nil
 }
 
 func selectDevice(callResp xconn.CallResponse) (int, error) {
@@ -240,12 +626,37 @@ func selectDevice(callResp xconn.CallResponse) (int, error) {
 func usage() {
 	fmt.Println(`Usage:
   deskconnctl attach [--name|-n <name>] [--password-stdin] <username>
-  deskconnctl shell  [--password-stdin] <username>
+  deskconnctl attach [--name|-n <name>] --code <XXXX-XXXX>
+  deskconnctl pair   [--ttl <duration>] [--password-stdin] <username>
+  deskconnctl detach
+  deskconnctl rotate-key
+  deskconnctl migrate-key --to <plain|passphrase|secret-service> [--passphrase-stdin]
+  deskconnctl profile [--uri <uri>] [--realm <realm>]
+  deskconnctl profiles
+  deskconnctl shell  [--resume <id>] [--command <path>] [--login] [--cwd <dir>] [--env KEY=VALUE]...
+                     [--share-write] [--password-stdin] <username>
+  deskconnctl shell  --watch <id> [--write] [--password-stdin] <username>
+  deskconnctl exec   [--timeout <duration>] [--cwd <dir>] [--stdin] [--password-stdin] <username> -- <command> [args...]
+
+Every command except profiles takes --profile <name> to work with the cloud of
+that profile, stored in $XDG_CONFIG_HOME/deskconn/profiles/<name>.json. The
+default profile is "default", or DESKCONN_PROFILE when set.
 
 Examples:
   deskconnctl attach admin
   deskconnctl attach -n laptop admin
+  deskconnctl pair --ttl 30m admin
+  deskconnctl attach --code K7QD-92MX
+  deskconnctl detach
+  deskconnctl rotate-key
+  deskconnctl migrate-key --to secret-service
+  deskconnctl profile --profile staging --uri wss://staging.example.com/ws
+  deskconnctl attach --profile staging admin
   deskconnctl shell admin
+  deskconnctl shell --resume 3f2a9c1e5b7d4a60 admin
+  deskconnctl shell --login --cwd /srv --env LANG=C.UTF-8 admin
+  deskconnctl shell --watch 3f2a9c1e5b7d4a60 admin
+  deskconnctl exec --timeout 1m admin -- journalctl -u deskconnd -n 50
   echo secret | deskconnctl attach --password-stdin admin
   echo secret | deskconnctl shell admin --password-stdin`)
 }
@@ -4,8 +4,12 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/godbus/dbus/v5"
 	log "github.com/sirupsen/logrus"
@@ -20,11 +24,6 @@ const (
 )
 
 func main() {
-	cred, err := deskconn.EnsureCredentials()
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	host, _ := os.Hostname()
 
 	router, err := xconn.NewRouter(xconn.DefaultRouterConfig())
@@ -32,12 +31,14 @@ func main() {
 		log.Fatalln(err)
 	}
 	err = router.AddRealm(realm, &xconn.RealmConfig{
+		AutoDiscloseCaller: true,
 		Roles: []xconn.RealmRole{
 			{Name: "anonymous", Permissions: []xconn.Permission{
 				{
-					URI:         "io.xconn.",
-					MatchPolicy: "prefix",
-					AllowCall:   true,
+					URI:            "io.xconn.",
+					MatchPolicy:    "prefix",
+					AllowCall:      true,
+					AllowSubscribe: true,
 				},
 			}},
 		},
@@ -45,6 +46,9 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if err := router.EnableMetaAPI(realm); err != nil {
+		log.Fatalln(err)
+	}
 
 	server := xconn.NewServer(router, nil, &xconn.ServerConfig{})
 	listener, err := server.ListenAndServeWebSocket(xconn.NetworkTCP, "0.0.0.0:8080")
@@ -71,64 +75,249 @@ func main() {
 	defer sessionBus.Close()
 
 	screen := deskconn.NewScreen(sessionBus, systemBus)
+	defer screen.Close()
+	if helper, ok := os.LookupEnv("DESKCONN_BRIGHTNESS_HELPER"); ok {
+		screen.SetBrightnessBackend(deskconn.NewCommandBrightnessBackend(helper))
+	}
+	if command, ok := os.LookupEnv("DESKCONN_DISPLAY_POWER_COMMAND"); ok {
+		screen.SetDisplayPowerCommand(command)
+	}
 	deskconnApis := deskconn.NewDeskconn(screen)
+	deskconnApis.SetShellConfig(shellConfigFromEnv())
+	if value, ok := os.LookupEnv("DESKCONN_SHELL_GRACE_PERIOD"); ok {
+		grace, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("invalid DESKCONN_SHELL_GRACE_PERIOD: %v", err)
+		}
+		deskconnApis.SetShellGracePeriod(grace)
+	}
+	if value, ok := os.LookupEnv("DESKCONN_SHELL_SCROLLBACK"); ok {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("invalid DESKCONN_SHELL_SCROLLBACK: %v", err)
+		}
+		deskconnApis.SetShellScrollback(size)
+	}
+	deskconnApis.SetShellLimits(durationFromEnv("DESKCONN_SHELL_IDLE_TIMEOUT"),
+		durationFromEnv("DESKCONN_SHELL_MAX_LIFETIME"))
+	if err := deskconnApis.SetShellRecording(shellRecordingFromEnv()); err != nil {
+		log.Fatal(err)
+	}
 
 	if err := deskconnApis.RegisterLocal(localSession); err != nil {
 		log.Fatal(err)
 	}
 
-	go func() {
-		machineID, err := os.ReadFile(deskconn.MachineIDPath)
+	machineID, err := os.ReadFile(deskconn.MachineIDPath)
+	if err != nil {
+		log.Fatalln("failed to read machine-id: ", err)
+	}
+	machineIDStr := strings.TrimSpace(string(machineID))
+
+	for _, profile := range cloudProfiles() {
+		go serveCloudProfile(deskconnApis, profile, machineIDStr)
+	}
+
+	zeroconfServer, err := deskconn.AdvertiseService(host, port, realm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zeroconfServer.Shutdown()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	<-sigChan
+}
+
+// cloudProfiles returns the profiles whose clouds deskconnd connects to, named
+// in DESKCONN_PROFILES separated by commas or whitespace, or else the stored
+// profiles along with the default one, which may still be in the credentials
+// file of older versions.
+func cloudProfiles() []string {
+	profiles := strings.FieldsFunc(os.Getenv("DESKCONN_PROFILES"), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(profiles) != 0 {
+		return profiles
+	}
+
+	profiles, err := deskconn.ListProfiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !slices.Contains(profiles, deskconn.DefaultProfile) {
+		profiles = append([]string{deskconn.DefaultProfile}, profiles...)
+	}
+	return profiles
+}
+
+// serveCloudProfile keeps the desktop connected to the cloud of a profile,
+// once it is attached there. A profile that cannot be loaded is retried with
+// backoff, leaving the desktop and its other clouds running.
+func serveCloudProfile(deskconnApis *deskconn.Deskconn, profileName, machineID string) {
+	retryDelay := 1 * time.Second
+	maxDelay := 30 * time.Second
+	for {
+		profile, cred, err := deskconn.EnsureCredentials(profileName)
 		if err != nil {
-			log.Fatalln("failed to read machine-id: ", err)
+			log.Printf("failed to load profile %s, will retry in %v: %v", profileName, retryDelay, err)
+			time.Sleep(retryDelay)
+			retryDelay = min(retryDelay*2, maxDelay)
+			continue
+		}
+		retryDelay = 1 * time.Second
+		if cred.KeyExpired() {
+			log.Printf("cloud key of profile %s is older than %d days, rotate it with "+
+				"'deskconnctl rotate-key --profile %s'", profileName, int(deskconn.KeyMaxAge.Hours()/24), profileName)
+		}
+
+		// Stay connected with these credentials until the key is rotated or
+		// the desktop detached, then start over with the new ones.
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			if err := deskconn.WaitCredentialsChanged(ctx, profileName); err == nil {
+				log.Printf("profile %s changed, reconnecting to cloud", profileName)
+				cancel()
+			} else if ctx.Err() == nil {
+				log.Printf("failed to watch profile %s: %v", profileName, err)
+			}
+		}()
+
+		connectCloud(ctx, deskconnApis, profile, cred, machineID)
+		cancel()
+	}
+}
+
+// connectCloud keeps the desktop connected to the cloud of a profile,
+// reconnecting with backoff, until ctx is done.
+func connectCloud(ctx context.Context, deskconnApis *deskconn.Deskconn, profile *deskconn.Profile,
+	cred *deskconn.Credentials, machineID string) {
+	retryDelay := 1 * time.Second
+	maxDelay := 30 * time.Second
+	backoff := func() bool {
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return false
 		}
-		machineIDStr := strings.TrimSpace(string(machineID))
-
-		retryDelay := 1 * time.Second
-		maxDelay := 30 * time.Second
-		for {
-			cloudSession, err := xconn.ConnectCryptosign(context.Background(), deskconn.CloudURI(), deskconn.Realm,
-				cred.AuthID, cred.PrivateKey)
-			if err != nil {
-				log.Printf("failed to connect to cloud, will retry in %v: %v", retryDelay, err)
-
-				// exponential backoff
-				retryDelay *= 2
-				if retryDelay > maxDelay {
-					retryDelay = maxDelay
-				}
-				continue
+
+		// exponential backoff
+		retryDelay *= 2
+		if retryDelay > maxDelay {
+			retryDelay = maxDelay
+		}
+		return true
+	}
+
+	for ctx.Err() == nil {
+		cloudSession, err := profile.ConnectCryptosign(ctx, cred)
+		if err != nil {
+			log.Printf("failed to connect to cloud of profile %s, will retry in %v: %v", profile.Name,
+				retryDelay, err)
+			if !backoff() {
+				return
 			}
+			continue
+		}
 
-			log.Println("connected successfully to cloud")
+		log.Printf("connected successfully to cloud of profile %s", profile.Name)
 
-			// reset backoff after successful connection
-			retryDelay = 1 * time.Second
+		// reset backoff after successful connection
+		retryDelay = 1 * time.Second
 
-			if err := deskconnApis.RegisterCloud(cloudSession, machineIDStr); err != nil {
-				// exponential backoff
-				retryDelay *= 2
-				if retryDelay > maxDelay {
-					retryDelay = maxDelay
-				}
-				log.Printf("failed to register procedures on cloud, will retry in %v: %v", retryDelay, err)
-				_ = cloudSession.Leave()
+		if err := deskconnApis.RegisterCloud(cloudSession, machineID); err != nil {
+			log.Printf("failed to register procedures on cloud of profile %s, will retry in %v: %v",
+				profile.Name, retryDelay, err)
+			deskconnApis.UnregisterCloud(cloudSession)
+			if !backoff() {
+				return
 			}
+			continue
+		}
+
+		// wait for session to disconnect
+		select {
+		case <-cloudSession.Done():
+			log.Printf("disconnected from cloud of profile %s, retrying...", profile.Name)
+			deskconnApis.UnregisterCloud(cloudSession)
+		case <-ctx.Done():
+			deskconnApis.UnregisterCloud(cloudSession)
+			return
+		}
+	}
+}
 
-			// wait for session to disconnect
-			<-cloudSession.Done()
+// shellConfigFromEnv reads how remote shells are started from the
+// DESKCONN_SHELL_* variables. Allowed commands and directories are separated
+// like PATH, and environment variables and their names by whitespace.
+func shellConfigFromEnv() deskconn.ShellConfig {
+	config := deskconn.ShellConfig{
+		Command:    os.Getenv("DESKCONN_SHELL_COMMAND"),
+		Dir:        os.Getenv("DESKCONN_SHELL_DIR"),
+		User:       os.Getenv("DESKCONN_SHELL_USER"),
+		Env:        strings.Fields(os.Getenv("DESKCONN_SHELL_ENV")),
+		AllowedEnv: strings.Fields(os.Getenv("DESKCONN_SHELL_ALLOWED_ENV")),
+	}
 
-			log.Println("disconnected from cloud, retrying...")
+	if value, ok := os.LookupEnv("DESKCONN_SHELL_LOGIN"); ok {
+		login, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("invalid DESKCONN_SHELL_LOGIN: %v", err)
 		}
-	}()
+		config.Login = login
+	}
 
-	zeroconfServer, err := deskconn.AdvertiseService(host, port, realm)
+	if value := os.Getenv("DESKCONN_SHELL_ALLOWED_COMMANDS"); value != "" {
+		config.AllowedCommands = filepath.SplitList(value)
+	}
+	if value := os.Getenv("DESKCONN_SHELL_ALLOWED_DIRS"); value != "" {
+		config.AllowedDirs = filepath.SplitList(value)
+	}
+
+	return config
+}
+
+// durationFromEnv reads a duration such as "30m" from the environment, zero
+// if the variable is not set.
+func durationFromEnv(name string) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("invalid %s: %v", name, err)
 	}
-	defer zeroconfServer.Shutdown()
+	return duration
+}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-	<-sigChan
+// shellRecordingFromEnv reads where shells are recorded and for how long from
+// the DESKCONN_SHELL_RECORDING_* variables.
+func shellRecordingFromEnv() deskconn.ShellRecording {
+	recording := deskconn.ShellRecording{Dir: os.Getenv("DESKCONN_SHELL_RECORDING_DIR")}
+
+	if value, ok := os.LookupEnv("DESKCONN_SHELL_RECORDING_MAX_AGE"); ok {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("invalid DESKCONN_SHELL_RECORDING_MAX_AGE: %v", err)
+		}
+		recording.MaxAge = maxAge
+	}
+	if value, ok := os.LookupEnv("DESKCONN_SHELL_RECORDING_MAX_FILES"); ok {
+		maxFiles, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("invalid DESKCONN_SHELL_RECORDING_MAX_FILES: %v", err)
+		}
+		recording.MaxFiles = maxFiles
+	}
+	if value, ok := os.LookupEnv("DESKCONN_SHELL_RECORDING_MAX_BYTES"); ok {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid DESKCONN_SHELL_RECORDING_MAX_BYTES: %v", err)
+		}
+		recording.MaxBytes = maxBytes
+	}
+
+	return recording
 }
@@ -2,7 +2,10 @@ package deskconn
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -10,72 +13,358 @@ import (
 )
 
 const (
-	ProcedureScreenBrightnessGet = "io.xconn.deskconn.deskconnd.screen.brightness.get"
-	ProcedureScreenBrightnessSet = "io.xconn.deskconn.deskconnd.screen.brightness.set"
-	ProcedureScreenLock          = "io.xconn.deskconn.deskconnd.screen.lock"
-	ProcedureScreenIsLocked      = "io.xconn.deskconn.deskconnd.screen.islocked"
-	ProcedureShell               = "io.xconn.deskconn.deskconnd.shell"
-
-	ProcedureScreenBrightnessGetCloud = "io.xconn.deskconn.deskconnd.%s.screen.brightness.get"
-	ProcedureScreenBrightnessSetCloud = "io.xconn.deskconn.deskconnd.%s.screen.brightness.set"
-	ProcedureScreenLockCloud          = "io.xconn.deskconn.deskconnd.%s.screen.lock"
-	ProcedureScreenIsLockedCloud      = "io.xconn.deskconn.deskconnd.%s.screen.islocked"
-	ProcedureShellCloud               = "io.xconn.deskconn.deskconnd.%s.shell"
+	ProcedureScreenBrightnessGet   = "io.xconn.deskconn.deskconnd.screen.brightness.get"
+	ProcedureScreenBrightnessSet   = "io.xconn.deskconn.deskconnd.screen.brightness.set"
+	ProcedureScreenBrightnessInfo  = "io.xconn.deskconn.deskconnd.screen.brightness.info"
+	ProcedureScreenBacklightList   = "io.xconn.deskconn.deskconnd.screen.backlight.list"
+	ProcedureKeyboardBrightnessGet = "io.xconn.deskconn.deskconnd.keyboard.brightness.get"
+	ProcedureKeyboardBrightnessSet = "io.xconn.deskconn.deskconnd.keyboard.brightness.set"
+	ProcedureScreenLock            = "io.xconn.deskconn.deskconnd.screen.lock"
+	ProcedureScreenIsLocked        = "io.xconn.deskconn.deskconnd.screen.islocked"
+	ProcedureScreenUnlock          = "io.xconn.deskconn.deskconnd.screen.unlock"
+	ProcedureScreenLockInfo        = "io.xconn.deskconn.deskconnd.screen.lock.info"
+	ProcedureScreenIdleGet         = "io.xconn.deskconn.deskconnd.screen.idle.get"
+	ProcedureScreenIdleInhibit     = "io.xconn.deskconn.deskconnd.screen.idle.inhibit"
+	ProcedureScreenIdleUninhibit   = "io.xconn.deskconn.deskconnd.screen.idle.uninhibit"
+	ProcedureScreenPowerGet        = "io.xconn.deskconn.deskconnd.screen.power.get"
+	ProcedureScreenPowerSet        = "io.xconn.deskconn.deskconnd.screen.power.set"
+	ProcedureShell                 = "io.xconn.deskconn.deskconnd.shell"
+	ProcedureShellList             = "io.xconn.deskconn.deskconnd.shell.list"
+	ProcedureShellAttach           = "io.xconn.deskconn.deskconnd.shell.attach"
+	ProcedureShellKill             = "io.xconn.deskconn.deskconnd.shell.kill"
+	ProcedureShellWatch            = "io.xconn.deskconn.deskconnd.shell.watch"
+	ProcedureExec                  = "io.xconn.deskconn.deskconnd.exec"
+	ProcedureShellRecordingsList   = "io.xconn.deskconn.deskconnd.shell.recordings.list"
+	ProcedureShellRecordingsGet    = "io.xconn.deskconn.deskconnd.shell.recordings.get"
+
+	ProcedureScreenBrightnessGetCloud   = "io.xconn.deskconn.deskconnd.%s.screen.brightness.get"
+	ProcedureScreenBrightnessSetCloud   = "io.xconn.deskconn.deskconnd.%s.screen.brightness.set"
+	ProcedureScreenBrightnessInfoCloud  = "io.xconn.deskconn.deskconnd.%s.screen.brightness.info"
+	ProcedureScreenBacklightListCloud   = "io.xconn.deskconn.deskconnd.%s.screen.backlight.list"
+	ProcedureKeyboardBrightnessGetCloud = "io.xconn.deskconn.deskconnd.%s.keyboard.brightness.get"
+	ProcedureKeyboardBrightnessSetCloud = "io.xconn.deskconn.deskconnd.%s.keyboard.brightness.set"
+	ProcedureScreenLockCloud            = "io.xconn.deskconn.deskconnd.%s.screen.lock"
+	ProcedureScreenIsLockedCloud        = "io.xconn.deskconn.deskconnd.%s.screen.islocked"
+	ProcedureScreenUnlockCloud          = "io.xconn.deskconn.deskconnd.%s.screen.unlock"
+	ProcedureScreenLockInfoCloud        = "io.xconn.deskconn.deskconnd.%s.screen.lock.info"
+	ProcedureScreenIdleGetCloud         = "io.xconn.deskconn.deskconnd.%s.screen.idle.get"
+	ProcedureScreenIdleInhibitCloud     = "io.xconn.deskconn.deskconnd.%s.screen.idle.inhibit"
+	ProcedureScreenIdleUninhibitCloud   = "io.xconn.deskconn.deskconnd.%s.screen.idle.uninhibit"
+	ProcedureScreenPowerGetCloud        = "io.xconn.deskconn.deskconnd.%s.screen.power.get"
+	ProcedureScreenPowerSetCloud        = "io.xconn.deskconn.deskconnd.%s.screen.power.set"
+	ProcedureShellCloud                 = "io.xconn.deskconn.deskconnd.%s.shell"
+	ProcedureShellListCloud             = "io.xconn.deskconn.deskconnd.%s.shell.list"
+	ProcedureShellAttachCloud           = "io.xconn.deskconn.deskconnd.%s.shell.attach"
+	ProcedureShellKillCloud             = "io.xconn.deskconn.deskconnd.%s.shell.kill"
+	ProcedureShellWatchCloud            = "io.xconn.deskconn.deskconnd.%s.shell.watch"
+	ProcedureExecCloud                  = "io.xconn.deskconn.deskconnd.%s.exec"
+	ProcedureShellRecordingsListCloud   = "io.xconn.deskconn.deskconnd.%s.shell.recordings.list"
+	ProcedureShellRecordingsGetCloud    = "io.xconn.deskconn.deskconnd.%s.shell.recordings.get"
+
+	TopicScreenLockChanged       = "io.xconn.deskconn.deskconnd.screen.lock.changed"
+	TopicScreenBrightnessChanged = "io.xconn.deskconn.deskconnd.screen.brightness.changed"
+
+	TopicScreenLockChangedCloud       = "io.xconn.deskconn.deskconnd.%s.screen.lock.changed"
+	TopicScreenBrightnessChangedCloud = "io.xconn.deskconn.deskconnd.%s.screen.brightness.changed"
 
 	ErrInvalidArgument = "wamp.error.invalid_argument"
 	ErrOperationFailed = "wamp.error.operation_failed"
+	ErrNotAuthorized   = "wamp.error.not_authorized"
 )
 
 type Deskconn struct {
 	screen       *Screen
 	shellSession *interactiveShellSession
+
+	localSession   *xconn.Session
+	clouds         map[*xconn.Session]*cloudRegistration
+	idleInhibitors map[callerKey]func() error
+	sync.Mutex
+}
+
+// cloudRegistration is what the desktop registered on one cloud router.
+type cloudRegistration struct {
+	machineID     string
+	registrations []xconn.RegisterResponse
+}
+
+func (c *cloudRegistration) unregister() {
+	for _, registration := range c.registrations {
+		if err := registration.Unregister(); err != nil {
+			log.Printf("failed to unregister procedure from cloud: %v", err)
+		}
+	}
 }
 
 func NewDeskconn(screen *Screen) *Deskconn {
-	return &Deskconn{
-		screen:       screen,
-		shellSession: newInteractiveShellSession(),
+	d := &Deskconn{
+		screen:         screen,
+		shellSession:   newInteractiveShellSession(),
+		clouds:         make(map[*xconn.Session]*cloudRegistration),
+		idleInhibitors: make(map[callerKey]func() error),
 	}
+
+	screen.OnLockChanged(func(locked bool) {
+		d.publish(TopicScreenLockChanged, TopicScreenLockChangedCloud, []any{locked}, nil)
+	})
+	screen.OnBrightnessChanged(func(device string, percent int) {
+		d.publish(TopicScreenBrightnessChanged, TopicScreenBrightnessChangedCloud, []any{percent},
+			map[string]any{"device": device})
+	})
+
+	return d
+}
+
+// SetShellConfig sets how shells are started for callers.
+func (d *Deskconn) SetShellConfig(config ShellConfig) {
+	d.shellSession.setConfig(config)
+}
+
+// SetShellGracePeriod sets how long a shell keeps running after its client
+// disconnected, waiting to be resumed.
+func (d *Deskconn) SetShellGracePeriod(grace time.Duration) {
+	d.shellSession.setGracePeriod(grace)
+}
+
+// SetShellScrollback sets how many bytes of recent output each shell keeps to
+// replay when a client resumes it.
+func (d *Deskconn) SetShellScrollback(size int) {
+	d.shellSession.setScrollbackSize(size)
+}
+
+// SetShellLimits closes shells that saw no input or output for idleTimeout
+// or have been running for maxLifetime, warning the user shortly before. A
+// zero value disables the limit.
+func (d *Deskconn) SetShellLimits(idleTimeout, maxLifetime time.Duration) {
+	d.shellSession.setLimits(idleTimeout, maxLifetime)
+}
+
+// SetShellRecording enables recording shells to the given directory, or
+// disables it when the directory is empty.
+func (d *Deskconn) SetShellRecording(recording ShellRecording) error {
+	return d.shellSession.setRecording(recording)
 }
 
 func (d *Deskconn) RegisterLocal(session *xconn.Session) error {
+	d.Lock()
+	d.localSession = session
+	d.Unlock()
+
+	d.subscribeSessionLeave(session)
+
 	for uri, handler := range map[string]xconn.InvocationHandler{
-		ProcedureScreenBrightnessGet: d.brightnessGetHandler,
-		ProcedureScreenBrightnessSet: d.brightnessSetHandler,
-		ProcedureScreenLock:          d.lockScreenLockHandler,
-		ProcedureScreenIsLocked:      d.lockScreenIsLockedHandler,
-		ProcedureShell:               d.shellSession.handleShell(),
+		ProcedureScreenBrightnessGet:   d.brightnessGetHandler,
+		ProcedureScreenBrightnessSet:   d.brightnessSetHandler,
+		ProcedureScreenBrightnessInfo:  d.brightnessInfoHandler,
+		ProcedureScreenBacklightList:   d.backlightListHandler,
+		ProcedureKeyboardBrightnessGet: d.keyboardBrightnessGetHandler,
+		ProcedureKeyboardBrightnessSet: d.keyboardBrightnessSetHandler,
+		ProcedureScreenLock:            d.lockScreenLockHandler,
+		ProcedureScreenIsLocked:        d.lockScreenIsLockedHandler,
+		ProcedureScreenUnlock:          d.lockScreenUnlockHandler,
+		ProcedureScreenLockInfo:        d.lockScreenInfoHandler,
+		ProcedureScreenIdleGet:         d.idleGetHandler,
+		ProcedureScreenIdleInhibit:     d.idleInhibitHandler,
+		ProcedureScreenIdleUninhibit:   d.idleUninhibitHandler,
+		ProcedureScreenPowerGet:        d.powerGetHandler,
+		ProcedureScreenPowerSet:        d.powerSetHandler,
+		ProcedureShell:                 d.shellSession.handleShell(),
+		ProcedureShellList:             d.shellSession.handleShellList(),
+		ProcedureShellAttach:           d.shellSession.handleShellAttach(),
+		ProcedureShellKill:             d.shellSession.handleShellKill(),
+		ProcedureShellWatch:            d.shellSession.handleShellWatch(),
+		ProcedureExec:                  d.shellSession.handleExec(),
+		ProcedureShellRecordingsList:   d.shellSession.handleRecordingsList(),
+		ProcedureShellRecordingsGet:    d.shellSession.handleRecordingsGet(),
 	} {
-		response := session.Register(uri, handler).Do()
+		response := session.Register(uri, throughRouter(session, handler)).Do()
 		if response.Err != nil {
 			return response.Err
 		}
 
 		log.Printf("Registered procedure %s", uri)
 	}
+
 	return nil
 }
 
+// RegisterCloud registers the procedures of the desktop on a cloud router.
+// The desktop can be registered on several clouds at once, each over its own
+// session. On failure nothing is left registered on that cloud.
 func (d *Deskconn) RegisterCloud(session *xconn.Session, machineID string) error {
+	d.subscribeSessionLeave(session)
+
+	cloud := &cloudRegistration{machineID: machineID}
+
 	for uri, handler := range map[string]xconn.InvocationHandler{
-		fmt.Sprintf(ProcedureScreenBrightnessGetCloud, machineID): d.brightnessGetHandler,
-		fmt.Sprintf(ProcedureScreenBrightnessSetCloud, machineID): d.brightnessSetHandler,
-		fmt.Sprintf(ProcedureScreenLockCloud, machineID):          d.lockScreenLockHandler,
-		fmt.Sprintf(ProcedureScreenIsLockedCloud, machineID):      d.lockScreenIsLockedHandler,
-		fmt.Sprintf(ProcedureShellCloud, machineID):               d.shellSession.handleShell(),
+		fmt.Sprintf(ProcedureScreenBrightnessGetCloud, machineID):   d.brightnessGetHandler,
+		fmt.Sprintf(ProcedureScreenBrightnessSetCloud, machineID):   d.brightnessSetHandler,
+		fmt.Sprintf(ProcedureScreenBrightnessInfoCloud, machineID):  d.brightnessInfoHandler,
+		fmt.Sprintf(ProcedureScreenBacklightListCloud, machineID):   d.backlightListHandler,
+		fmt.Sprintf(ProcedureKeyboardBrightnessGetCloud, machineID): d.keyboardBrightnessGetHandler,
+		fmt.Sprintf(ProcedureKeyboardBrightnessSetCloud, machineID): d.keyboardBrightnessSetHandler,
+		fmt.Sprintf(ProcedureScreenLockCloud, machineID):            d.lockScreenLockHandler,
+		fmt.Sprintf(ProcedureScreenIsLockedCloud, machineID):        d.lockScreenIsLockedHandler,
+		fmt.Sprintf(ProcedureScreenUnlockCloud, machineID):          d.lockScreenUnlockHandler,
+		fmt.Sprintf(ProcedureScreenLockInfoCloud, machineID):        d.lockScreenInfoHandler,
+		fmt.Sprintf(ProcedureScreenIdleGetCloud, machineID):         d.idleGetHandler,
+		fmt.Sprintf(ProcedureScreenIdleInhibitCloud, machineID):     d.idleInhibitHandler,
+		fmt.Sprintf(ProcedureScreenIdleUninhibitCloud, machineID):   d.idleUninhibitHandler,
+		fmt.Sprintf(ProcedureScreenPowerGetCloud, machineID):        d.powerGetHandler,
+		fmt.Sprintf(ProcedureScreenPowerSetCloud, machineID):        d.powerSetHandler,
+		fmt.Sprintf(ProcedureShellCloud, machineID):                 d.shellSession.handleShell(),
+		fmt.Sprintf(ProcedureShellListCloud, machineID):             d.shellSession.handleShellList(),
+		fmt.Sprintf(ProcedureShellAttachCloud, machineID):           d.shellSession.handleShellAttach(),
+		fmt.Sprintf(ProcedureShellKillCloud, machineID):             d.shellSession.handleShellKill(),
+		fmt.Sprintf(ProcedureShellWatchCloud, machineID):            d.shellSession.handleShellWatch(),
+		fmt.Sprintf(ProcedureExecCloud, machineID):                  d.shellSession.handleExec(),
+		fmt.Sprintf(ProcedureShellRecordingsListCloud, machineID):   d.shellSession.handleRecordingsList(),
+		fmt.Sprintf(ProcedureShellRecordingsGetCloud, machineID):    d.shellSession.handleRecordingsGet(),
 	} {
-		response := session.Register(uri, handler).Do()
+		response := session.Register(uri, throughRouter(session, handler)).Do()
 		if response.Err != nil {
+			cloud.unregister()
 			return response.Err
 		}
 
+		cloud.registrations = append(cloud.registrations, response)
 		log.Printf("Registered procedure %s", uri)
 	}
+
+	d.Lock()
+	d.clouds[session] = cloud
+	d.Unlock()
 	return nil
 }
 
-func (d *Deskconn) brightnessGetHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
-	brightness, err := d.screen.GetBrightness()
+// UnregisterCloud withdraws the procedures registered over a cloud session and
+// leaves it, as when the desktop is detached from that cloud. Other clouds are
+// left alone. Whatever callers on that cloud still held is released, as their
+// leave events no longer reach the desktop.
+func (d *Deskconn) UnregisterCloud(session *xconn.Session) {
+	d.Lock()
+	cloud, ok := d.clouds[session]
+	delete(d.clouds, session)
+	d.Unlock()
+
+	d.releaseRouter(session)
+	if !session.Connected() {
+		return
+	}
+
+	if ok {
+		cloud.unregister()
+	}
+	if err := session.Leave(); err != nil {
+		log.Printf("failed to leave cloud session: %v", err)
+	}
+}
+
+// subscribeSessionLeave follows callers leaving the router so resources held
+// on their behalf can be released. Routers that do not tell are still served:
+// shells started through them close once idle for the grace period, and what
+// their callers hold is released when the desktop detaches from the router.
+func (d *Deskconn) subscribeSessionLeave(session *xconn.Session) {
+	if response := session.Call(xconn.MetaProcedureSessionCount).Do(); response.Err != nil {
+		log.Printf("router does not expose the session meta API, callers leaving will go unnoticed: %v",
+			response.Err)
+		d.shellSession.unfollowRouter(session)
+		return
+	}
+
+	response := session.Subscribe(xconn.MetaTopicSessionLeave, d.sessionLeaveHandler(session)).Do()
+	if response.Err != nil {
+		log.Printf("failed to subscribe to %s, callers leaving will go unnoticed: %v",
+			xconn.MetaTopicSessionLeave, response.Err)
+		d.shellSession.unfollowRouter(session)
+	}
+}
+
+func (d *Deskconn) sessionLeaveHandler(router *xconn.Session) xconn.EventHandler {
+	return func(event *xconn.Event) {
+		id, err := event.ArgUInt64(0)
+		if err != nil {
+			return
+		}
+
+		caller := callerKey{router: router, session: id}
+		_ = d.releaseIdleInhibitor(caller)
+		d.shellSession.detachCaller(caller)
+	}
+}
+
+// releaseRouter releases what callers reaching the desktop through the router
+// hold.
+func (d *Deskconn) releaseRouter(router *xconn.Session) {
+	d.Lock()
+	var callers []callerKey
+	for caller := range d.idleInhibitors {
+		if caller.router == router {
+			callers = append(callers, caller)
+		}
+	}
+	d.Unlock()
+
+	for _, caller := range callers {
+		if err := d.releaseIdleInhibitor(caller); err != nil {
+			log.Printf("failed to release idle inhibitor: %v", err)
+		}
+	}
+	d.shellSession.detachRouter(router)
+}
+
+// callerKey identifies a caller. Session ids are only unique within a router,
+// and the desktop is reached through the local router and every cloud it is
+// attached to, so the desktop's own session on that router is part of the key.
+type callerKey struct {
+	router  *xconn.Session
+	session uint64
+}
+
+type routerContextKey struct{}
+
+// throughRouter lets the handler tell which router an invocation came through.
+func throughRouter(router *xconn.Session, handler xconn.InvocationHandler) xconn.InvocationHandler {
+	return func(ctx context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		return handler(context.WithValue(ctx, routerContextKey{}, router), inv)
+	}
+}
+
+func callerOf(ctx context.Context, inv *xconn.Invocation) callerKey {
+	router, _ := ctx.Value(routerContextKey{}).(*xconn.Session)
+	return callerKey{router: router, session: inv.Caller()}
+}
+
+// publish sends an event to the local realm and, when attached, to the
+// machine specific topic on the cloud.
+func (d *Deskconn) publish(topic, cloudTopic string, args []any, kwargs map[string]any) {
+	d.Lock()
+	localSession := d.localSession
+	clouds := make(map[*xconn.Session]string, len(d.clouds))
+	for session, cloud := range d.clouds {
+		clouds[session] = cloud.machineID
+	}
+	d.Unlock()
+
+	if localSession != nil && localSession.Connected() {
+		if response := localSession.Publish(topic).Args(args...).Kwargs(kwargs).Do(); response.Err != nil {
+			log.Printf("failed to publish %s: %v", topic, response.Err)
+		}
+	}
+
+	for cloudSession, machineID := range clouds {
+		if !cloudSession.Connected() {
+			continue
+		}
+		uri := fmt.Sprintf(cloudTopic, machineID)
+		if response := cloudSession.Publish(uri).Args(args...).Kwargs(kwargs).Do(); response.Err != nil {
+			log.Printf("failed to publish %s: %v", uri, response.Err)
+		}
+	}
+}
+
+func (d *Deskconn) brightnessGetHandler(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	brightness, err := d.screen.GetDeviceBrightness(inv.KwargStringOr("device", ""))
 	if err != nil {
 		return xconn.NewInvocationError(ErrInvalidArgument, err.Error())
 	}
@@ -84,12 +373,82 @@ func (d *Deskconn) brightnessGetHandler(_ context.Context, _ *xconn.Invocation)
 }
 
 func (d *Deskconn) brightnessSetHandler(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	device := inv.KwargStringOr("device", "")
+
+	var brightness int64
+	if delta, err := inv.KwargInt64("delta"); err == nil {
+		current, err := d.screen.GetDeviceBrightness(device)
+		if err != nil {
+			return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+		}
+		brightness = int64(current) + delta
+	} else {
+		brightness, err = inv.ArgInt64(0)
+		if err != nil {
+			return xconn.NewInvocationError(ErrInvalidArgument, err)
+		}
+	}
+
+	durationMs := inv.KwargInt64Or("duration_ms", 0)
+	if durationMs < 0 {
+		return xconn.NewInvocationError(ErrInvalidArgument, "duration_ms must not be negative")
+	}
+
+	duration := time.Duration(durationMs) * time.Millisecond
+	if err := d.screen.FadeDeviceBrightness(device, int(brightness), duration); err != nil {
+		if errors.Is(err, errBacklightNotFound) {
+			return xconn.NewInvocationError(ErrInvalidArgument, err.Error())
+		}
+		return xconn.NewInvocationError(ErrOperationFailed, err)
+	}
+
+	return xconn.NewInvocationResult()
+}
+
+func (d *Deskconn) brightnessInfoHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	info, err := d.screen.BrightnessInfo()
+	if err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+
+	return xconn.NewInvocationResult(map[string]any{
+		"backend": info.Backend,
+		"device":  info.Device,
+	})
+}
+
+func (d *Deskconn) backlightListHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	devices := d.screen.Backlights()
+	result := make([]any, 0, len(devices))
+	for _, device := range devices {
+		result = append(result, map[string]any{
+			"name":           device.Name,
+			"type":           device.Type,
+			"max_brightness": device.MaxBrightness,
+			"brightness":     device.Brightness,
+			"default":        device.Default,
+		})
+	}
+
+	return xconn.NewInvocationResult(result...)
+}
+
+func (d *Deskconn) keyboardBrightnessGetHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	brightness, err := d.screen.GetKeyboardBrightness()
+	if err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+
+	return xconn.NewInvocationResult(brightness)
+}
+
+func (d *Deskconn) keyboardBrightnessSetHandler(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
 	brightness, err := inv.ArgInt64(0)
 	if err != nil {
 		return xconn.NewInvocationError(ErrInvalidArgument, err)
 	}
 
-	if err := d.screen.SetBrightness(int(brightness)); err != nil {
+	if err := d.screen.SetKeyboardBrightness(int(brightness)); err != nil {
 		return xconn.NewInvocationError(ErrOperationFailed, err)
 	}
 
@@ -112,3 +471,95 @@ func (d *Deskconn) lockScreenIsLockedHandler(_ context.Context, _ *xconn.Invocat
 
 	return xconn.NewInvocationResult(isLocked)
 }
+
+func (d *Deskconn) lockScreenUnlockHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	if err := d.screen.Unlock(); err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+
+	return xconn.NewInvocationResult()
+}
+
+func (d *Deskconn) lockScreenInfoHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	info := d.screen.LockInfo()
+
+	return xconn.NewInvocationResult(map[string]any{
+		"service":             info.Service,
+		"is_locked_supported": info.IsLockedSupported,
+		"unlock_supported":    info.UnlockSupported,
+	})
+}
+
+func (d *Deskconn) powerGetHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	on, err := d.screen.DisplayPower()
+	if err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+
+	return xconn.NewInvocationResult(on)
+}
+
+func (d *Deskconn) powerSetHandler(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	on, err := inv.ArgBool(0)
+	if err != nil {
+		return xconn.NewInvocationError(ErrInvalidArgument, err.Error())
+	}
+
+	if err := d.screen.SetDisplayPower(on); err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+
+	return xconn.NewInvocationResult()
+}
+
+func (d *Deskconn) idleGetHandler(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	idle, err := d.screen.IdleTime()
+	if err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+
+	return xconn.NewInvocationResult(idle.Milliseconds())
+}
+
+func (d *Deskconn) idleInhibitHandler(ctx context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	caller := callerOf(ctx, inv)
+	if caller.session == 0 {
+		return xconn.NewInvocationError(ErrInvalidArgument, "caller identity not disclosed")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.idleInhibitors[caller]; ok {
+		return xconn.NewInvocationResult()
+	}
+
+	release, err := d.screen.InhibitIdle(inv.KwargStringOr("reason", "remote session active"))
+	if err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+	d.idleInhibitors[caller] = release
+
+	return xconn.NewInvocationResult()
+}
+
+func (d *Deskconn) idleUninhibitHandler(ctx context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	if err := d.releaseIdleInhibitor(callerOf(ctx, inv)); err != nil {
+		return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+	}
+
+	return xconn.NewInvocationResult()
+}
+
+func (d *Deskconn) releaseIdleInhibitor(caller callerKey) error {
+	d.Lock()
+	release, ok := d.idleInhibitors[caller]
+	delete(d.idleInhibitors, caller)
+	d.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return release()
+}
@@ -1,21 +1,40 @@
 package deskconn_test
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/stretchr/testify/require"
 
 	"github.com/xconnio/deskconn"
+	"github.com/xconnio/wampproto-go/serializers"
 	"github.com/xconnio/xconn-go"
 )
 
-func setupRouterAndConnectSessions(t *testing.T) (*xconn.Session, *xconn.Session) {
+func setupRouter(t testing.TB) *xconn.Router {
 	r, err := xconn.NewRouter(&xconn.RouterConfig{})
 	require.NoError(t, err)
 
-	err = r.AddRealm("realm1", xconn.DefaultRealmConfig())
+	err = r.AddRealm("realm1", &xconn.RealmConfig{AutoDiscloseCaller: true})
 	require.NoError(t, err)
+	require.NoError(t, r.EnableMetaAPI("realm1"))
+
+	return r
+}
+
+// connectAs joins the router as the given authid, as a user connecting from
+// several clients does.
+func connectAs(t testing.TB, r *xconn.Router, authID string) *xconn.Session {
+	base, err := xconn.ConnectInMemoryBase(r, "realm1", authID, "trusted", &serializers.MsgPackSerializer{}, 16)
+	require.NoError(t, err)
+	return xconn.NewSession(base, base.Serializer())
+}
+
+func setupRouterAndConnectSessions(t testing.TB) (*xconn.Session, *xconn.Session) {
+	r := setupRouter(t)
 
 	callee, err := xconn.ConnectInMemory(r, "realm1")
 	require.NoError(t, err)
@@ -61,3 +80,256 @@ func TestBrightnessGetSet(t *testing.T) {
 	require.GreaterOrEqual(t, updated, 0)
 	require.LessOrEqual(t, updated, 100)
 }
+
+func TestScreenLockChangedEvent(t *testing.T) {
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	providerConn := connectPrivateBus(t, address)
+	exportFakeScreenSaver(t, providerConn)
+
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	events := make(chan bool, 1)
+	subResp := caller.Subscribe(deskconn.TopicScreenLockChanged, func(event *xconn.Event) {
+		events <- event.ArgBoolOr(0, false)
+	}).Do()
+	require.NoError(t, subResp.Err)
+
+	err := providerConn.Emit("/ScreenSaver", "org.freedesktop.ScreenSaver.ActiveChanged", true)
+	require.NoError(t, err)
+
+	select {
+	case locked := <-events:
+		require.True(t, locked)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock changed event not received")
+	}
+}
+
+func TestBacklightList(t *testing.T) {
+	callee, caller := setupRouterAndConnectSessions(t)
+	mockBacklightDir(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = screen.Close() })
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	callResp := caller.Call(deskconn.ProcedureScreenBacklightList).Do()
+	require.NoError(t, callResp.Err)
+	require.Len(t, callResp.Args(), 1)
+
+	device, err := callResp.ArgDict(0)
+	require.NoError(t, err)
+	require.Equal(t, "intel_backlight", device.StringOr("name", ""))
+	require.Equal(t, int64(100), device.Int64Or("max_brightness", 0))
+	require.Equal(t, int64(20), device.Int64Or("brightness", 0))
+	require.True(t, device.BoolOr("default", false))
+
+	callResp = caller.Call(deskconn.ProcedureScreenBrightnessGet).Kwarg("device", "intel_backlight").Do()
+	require.NoError(t, callResp.Err)
+	require.Equal(t, int64(20), callResp.ArgInt64Or(0, 0))
+
+	callResp = caller.Call(deskconn.ProcedureScreenBrightnessSet).Arg(50).Kwarg("device", "missing").Do()
+	require.ErrorContains(t, callResp.Err, deskconn.ErrInvalidArgument)
+}
+
+func TestBrightnessSetDelta(t *testing.T) {
+	callee, caller := setupRouterAndConnectSessions(t)
+	tmp := mockBacklightDir(t)
+
+	address := startPrivateBus(t)
+	exportFakeLogind(t, connectPrivateBus(t, address), tmp)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = screen.Close() })
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	callResp := caller.Call(deskconn.ProcedureScreenBrightnessSet).Kwarg("delta", 10).Do()
+	require.NoError(t, callResp.Err)
+
+	callResp = caller.Call(deskconn.ProcedureScreenBrightnessSet).Kwarg("delta", -5).
+		Kwarg("duration_ms", 100).Do()
+	require.NoError(t, callResp.Err)
+
+	callResp = caller.Call(deskconn.ProcedureScreenBrightnessGet).Do()
+	require.NoError(t, callResp.Err)
+	require.Equal(t, int64(25), callResp.ArgInt64Or(0, 0))
+
+	callResp = caller.Call(deskconn.ProcedureScreenBrightnessSet).Arg(50).Kwarg("duration_ms", -1).Do()
+	require.ErrorContains(t, callResp.Err, deskconn.ErrInvalidArgument)
+}
+
+func TestBrightnessInfo(t *testing.T) {
+	callee, caller := setupRouterAndConnectSessions(t)
+	mockBacklightDir(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = screen.Close() })
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	callResp := caller.Call(deskconn.ProcedureScreenBrightnessInfo).Do()
+	require.NoError(t, callResp.Err)
+
+	info, err := callResp.ArgDict(0)
+	require.NoError(t, err)
+	require.Equal(t, deskconn.BrightnessBackendSysfs, info.StringOr("backend", ""))
+	require.Equal(t, "intel_backlight", info.StringOr("device", ""))
+}
+
+func TestScreenUnlockAndLockInfo(t *testing.T) {
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	fake := exportFakeScreenSaver(t, connectPrivateBus(t, address))
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	callResp := caller.Call(deskconn.ProcedureScreenLockInfo).Do()
+	require.NoError(t, callResp.Err)
+	info, err := callResp.ArgDict(0)
+	require.NoError(t, err)
+	require.Equal(t, "org.freedesktop.ScreenSaver", info.StringOr("service", ""))
+	require.True(t, info.BoolOr("is_locked_supported", false))
+	require.True(t, info.BoolOr("unlock_supported", false))
+
+	fake.active.Store(true)
+	callResp = caller.Call(deskconn.ProcedureScreenUnlock).Do()
+	require.NoError(t, callResp.Err)
+	require.False(t, fake.active.Load())
+}
+
+func TestIdleInhibitReleasedOnLeave(t *testing.T) {
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	fake := exportFakeIdleService(t, connectPrivateBus(t, address))
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	callResp := caller.Call(deskconn.ProcedureScreenIdleGet).Do()
+	require.NoError(t, callResp.Err)
+	require.Equal(t, int64(42000), callResp.ArgInt64Or(0, 0))
+
+	// inhibiting twice from the same caller holds a single inhibitor
+	for i := 0; i < 2; i++ {
+		callResp = caller.Call(deskconn.ProcedureScreenIdleInhibit).Kwarg("reason", "presentation").Do()
+		require.NoError(t, callResp.Err)
+	}
+	require.Equal(t, 1, fake.Inhibitors())
+
+	callResp = caller.Call(deskconn.ProcedureScreenIdleUninhibit).Do()
+	require.NoError(t, callResp.Err)
+	require.Equal(t, 0, fake.Inhibitors())
+
+	callResp = caller.Call(deskconn.ProcedureScreenIdleInhibit).Do()
+	require.NoError(t, callResp.Err)
+	require.Equal(t, 1, fake.Inhibitors())
+
+	require.NoError(t, caller.Leave())
+	require.Eventually(t, func() bool { return fake.Inhibitors() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestIdleInhibitPerRouter(t *testing.T) {
+	callee, caller := setupRouterAndConnectSessions(t)
+	cloud, cloudCaller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	fake := exportFakeIdleService(t, connectPrivateBus(t, address))
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+	require.NoError(t, d.RegisterCloud(cloud, "machine"))
+
+	require.NoError(t, caller.Call(deskconn.ProcedureScreenIdleInhibit).Do().Err)
+	procedure := fmt.Sprintf(deskconn.ProcedureScreenIdleInhibitCloud, "machine")
+	require.NoError(t, cloudCaller.Call(procedure).Do().Err)
+	require.Equal(t, 2, fake.Inhibitors())
+
+	// Callers on a detached cloud can no longer be seen leaving, so what they
+	// held is released with it.
+	d.UnregisterCloud(cloud)
+	require.Equal(t, 1, fake.Inhibitors())
+}
+
+func TestRegisterCloudFailure(t *testing.T) {
+	cloud, caller := setupRouterAndConnectSessions(t)
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+
+	// Another desktop already took one of the procedures of the machine.
+	taken := fmt.Sprintf(deskconn.ProcedureShellListCloud, "machine")
+	handler := func(context.Context, *xconn.Invocation) *xconn.InvocationResult {
+		return xconn.NewInvocationResult()
+	}
+	require.NoError(t, caller.Register(taken, handler).Do().Err)
+
+	require.Error(t, d.RegisterCloud(cloud, "machine"))
+	procedure := fmt.Sprintf(deskconn.ProcedureScreenIdleGetCloud, "machine")
+	require.ErrorContains(t, caller.Call(procedure).Do().Err, "wamp.error.no_such_procedure")
+
+	// Detaching afterwards still leaves the cloud.
+	d.UnregisterCloud(cloud)
+	require.False(t, cloud.Connected())
+}
+
+func TestRegisterWithoutMetaAPI(t *testing.T) {
+	r, err := xconn.NewRouter(&xconn.RouterConfig{})
+	require.NoError(t, err)
+	require.NoError(t, r.AddRealm("realm1", &xconn.RealmConfig{AutoDiscloseCaller: true}))
+
+	callee, err := xconn.ConnectInMemory(r, "realm1")
+	require.NoError(t, err)
+
+	caller := connectAs(t, r, "alice")
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(deskconn.ShellConfig{Command: "/bin/sh"})
+	d.SetShellGracePeriod(200 * time.Millisecond)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	// Callers leaving go unnoticed, so an unused shell is closed once it has
+	// been idle for the grace period instead.
+	sh := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+	sh.waitEnded(t)
+	require.Equal(t, "idle_timeout", sh.status["reason"])
+}
+
+func TestUnregisterCloud(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	// Staging and production clouds, each with its own router.
+	cloud, caller := setupRouterAndConnectSessions(t)
+	otherCloud, otherCaller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterCloud(cloud, "machine"))
+	require.NoError(t, d.RegisterCloud(otherCloud, "machine"))
+
+	procedure := fmt.Sprintf(deskconn.ProcedureShellListCloud, "machine")
+	require.NoError(t, caller.Call(procedure).Do().Err)
+	require.NoError(t, otherCaller.Call(procedure).Do().Err)
+
+	d.UnregisterCloud(cloud)
+	require.False(t, cloud.Connected())
+	require.ErrorContains(t, caller.Call(procedure).Do().Err, "wamp.error.no_such_procedure")
+
+	// The other cloud is left alone.
+	require.True(t, otherCloud.Connected())
+	require.NoError(t, otherCaller.Call(procedure).Do().Err)
+
+	// Detaching twice is harmless.
+	d.UnregisterCloud(cloud)
+}
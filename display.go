@@ -0,0 +1,99 @@
+package deskconn
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	mutterDisplayConfigService = "org.gnome.Mutter.DisplayConfig"
+	mutterDisplayConfigPath    = "/org/gnome/Mutter/DisplayConfig"
+	mutterPowerSaveMode        = "org.gnome.Mutter.DisplayConfig.PowerSaveMode"
+
+	// DPMS modes used by Mutter's PowerSaveMode property
+	powerSaveModeOn  int32 = 0
+	powerSaveModeOff int32 = 3
+)
+
+// SetDisplayPowerCommand configures the command used to switch displays on
+// and off when neither Mutter nor the screensaver can do it. The command is
+// run with "on" or "off" appended, e.g. "xset dpms force".
+func (s *Screen) SetDisplayPowerCommand(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.displayPowerCommand = strings.Fields(command)
+}
+
+// SetDisplayPower blanks or wakes the displays without locking the session.
+func (s *Screen) SetDisplayPower(on bool) error {
+	mode := powerSaveModeOff
+	if on {
+		mode = powerSaveModeOn
+	}
+
+	mutter := s.sessionBus.Object(mutterDisplayConfigService, mutterDisplayConfigPath)
+	if err := mutter.SetProperty(mutterPowerSaveMode, dbus.MakeVariant(mode)); err == nil {
+		return nil
+	}
+
+	if provider := s.activeLockProvider(); provider != nil && provider.setter != "" {
+		obj := s.sessionBus.Object(provider.service, provider.path)
+		if err := obj.Call(provider.iface+"."+provider.setter, 0, !on).Err; err == nil {
+			return nil
+		}
+	}
+
+	s.mu.Lock()
+	command := s.displayPowerCommand
+	s.mu.Unlock()
+	if len(command) == 0 {
+		return fmt.Errorf("display power control not available")
+	}
+
+	state := "off"
+	if on {
+		state = "on"
+	}
+
+	args := append(append([]string{}, command[1:]...), state)
+	output, err := exec.Command(command[0], args...).CombinedOutput() // #nosec G204
+	if err != nil {
+		return fmt.Errorf("display power command failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	s.mu.Lock()
+	s.displayOff = !on
+	s.mu.Unlock()
+	return nil
+}
+
+// DisplayPower reports whether the displays are currently on.
+func (s *Screen) DisplayPower() (bool, error) {
+	mutter := s.sessionBus.Object(mutterDisplayConfigService, mutterDisplayConfigPath)
+	if mode, err := mutter.GetProperty(mutterPowerSaveMode); err == nil {
+		if value, ok := mode.Value().(int32); ok {
+			return value == powerSaveModeOn, nil
+		}
+	}
+
+	if provider := s.activeLockProvider(); provider != nil && provider.setter != "" && provider.active != "" {
+		var active bool
+		obj := s.sessionBus.Object(provider.service, provider.path)
+		if err := obj.Call(provider.iface+"."+provider.active, 0).Store(&active); err == nil {
+			return !active, nil
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the command gives no feedback, so report what was last requested
+	if len(s.displayPowerCommand) == 0 {
+		return false, fmt.Errorf("display power control not available")
+	}
+	return !s.displayOff, nil
+}
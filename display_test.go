@@ -0,0 +1,86 @@
+package deskconn_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+func exportFakeMutter(t *testing.T, conn *dbus.Conn) *prop.Properties {
+	t.Helper()
+
+	props, err := prop.Export(conn, "/org/gnome/Mutter/DisplayConfig", prop.Map{
+		"org.gnome.Mutter.DisplayConfig": {
+			"PowerSaveMode": {Value: int32(0), Writable: true, Emit: prop.EmitTrue},
+		},
+	})
+	require.NoError(t, err)
+	_, err = conn.RequestName("org.gnome.Mutter.DisplayConfig", dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+
+	return props
+}
+
+func TestDisplayPowerMutter(t *testing.T) {
+	address := startPrivateBus(t)
+	props := exportFakeMutter(t, connectPrivateBus(t, address))
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	on, err := s.DisplayPower()
+	require.NoError(t, err)
+	require.True(t, on)
+
+	require.NoError(t, s.SetDisplayPower(false))
+	require.Equal(t, int32(3), props.GetMust("org.gnome.Mutter.DisplayConfig", "PowerSaveMode"))
+
+	on, err = s.DisplayPower()
+	require.NoError(t, err)
+	require.False(t, on)
+}
+
+func TestDisplayPowerScreenSaver(t *testing.T) {
+	address := startPrivateBus(t)
+	fake := exportFakeScreenSaver(t, connectPrivateBus(t, address))
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	require.NoError(t, s.SetDisplayPower(false))
+	require.True(t, fake.active.Load())
+
+	on, err := s.DisplayPower()
+	require.NoError(t, err)
+	require.False(t, on)
+
+	require.NoError(t, s.SetDisplayPower(true))
+	require.False(t, fake.active.Load())
+}
+
+func TestDisplayPowerCommand(t *testing.T) {
+	address := startPrivateBus(t)
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	_, err := s.DisplayPower()
+	require.EqualError(t, err, "display power control not available")
+	require.EqualError(t, s.SetDisplayPower(false), "display power control not available")
+
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "out")
+	script := filepath.Join(tmp, "power.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0700))
+
+	s.SetDisplayPowerCommand(script + " --force")
+	require.NoError(t, s.SetDisplayPower(false))
+
+	raw, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "--force off\n", string(raw))
+
+	on, err := s.DisplayPower()
+	require.NoError(t, err)
+	require.False(t, on)
+}
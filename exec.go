@@ -0,0 +1,234 @@
+package deskconn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xconnio/xconn-go"
+)
+
+// execWaitDelay bounds how long exec waits for output after the command
+// exited or was killed, in case a child it left behind holds on to the pipes.
+const execWaitDelay = 5 * time.Second
+
+// ExecOptions are the optional parts of a remote exec call.
+type ExecOptions struct {
+	Stdin   []byte
+	Timeout time.Duration
+	Dir     string
+	Env     map[string]string
+}
+
+// ExecResult describes how a remote command finished.
+type ExecResult struct {
+	ExitCode int
+	// Signal names the signal that ended the command, if any.
+	Signal     string
+	TimedOut   bool
+	Duration   time.Duration
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSS is the peak resident set size in kilobytes.
+	MaxRSS int64
+}
+
+// streamWriter forwards what a command writes to one of its output streams
+// as progressive results.
+type streamWriter struct {
+	stream string
+	inv    *xconn.Invocation
+	mu     *sync.Mutex
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.inv.SendProgress([]any{p}, map[string]any{"stream": w.stream}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (p *interactiveShellSession) handleExec() func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		command, err := inv.ArgString(0)
+		if err != nil {
+			return xconn.NewInvocationError(ErrInvalidArgument, "command is required")
+		}
+
+		args := make([]string, 0, inv.ArgsLen())
+		for i := 1; i < inv.ArgsLen(); i++ {
+			arg, err := inv.ArgString(i)
+			if err != nil {
+				return xconn.NewInvocationError(ErrInvalidArgument, "command arguments must be strings")
+			}
+			args = append(args, arg)
+		}
+
+		p.Lock()
+		config := p.config
+		p.Unlock()
+
+		if !config.allowsExec(command) {
+			return xconn.NewInvocationError(ErrNotAuthorized, fmt.Sprintf("%v: %s", errShellCommandNotAllowed, command))
+		}
+
+		ctx := context.Background()
+		if timeout := inv.KwargInt64Or("timeout_ms", 0); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+			defer cancel()
+		} else if timeout < 0 {
+			return xconn.NewInvocationError(ErrInvalidArgument, "timeout_ms must not be negative")
+		}
+
+		cmd := exec.CommandContext(ctx, command, args...) // #nosec G204
+		cmd.Env = os.Environ()
+		if err := config.prepare(cmd, inv); errors.Is(err, errShellDirNotAllowed) {
+			return xconn.NewInvocationError(ErrNotAuthorized, err.Error())
+		} else if err != nil {
+			return xconn.NewInvocationError(ErrInvalidArgument, err.Error())
+		}
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		// Kill whatever the command started along with it on timeout.
+		cmd.SysProcAttr.Setpgid = true
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		cmd.WaitDelay = execWaitDelay
+
+		if stdin, err := inv.KwargBytes("stdin"); err == nil {
+			cmd.Stdin = bytes.NewReader(stdin)
+		}
+
+		// Callers that do not take progressive results get the output along
+		// with the final result instead.
+		var stdout, stderr bytes.Buffer
+		if inv.SendProgress != nil {
+			var mu sync.Mutex
+			cmd.Stdout = &streamWriter{stream: "stdout", inv: inv, mu: &mu}
+			cmd.Stderr = &streamWriter{stream: "stderr", inv: inv, mu: &mu}
+		} else {
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+		}
+
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+		}
+
+		err = cmd.Wait()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) && !errors.Is(err, exec.ErrWaitDelay) {
+			return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+		}
+
+		result := execResult(cmd.ProcessState, time.Since(started))
+		result.Kwargs["timed_out"] = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		if inv.SendProgress == nil {
+			result.Kwargs["stdout"] = stdout.Bytes()
+			result.Kwargs["stderr"] = stderr.Bytes()
+		}
+		return result
+	}
+}
+
+func execResult(state *os.ProcessState, duration time.Duration) *xconn.InvocationResult {
+	result := xconn.NewInvocationResult(state.ExitCode())
+	result.Kwargs = map[string]any{
+		"exit_code":   state.ExitCode(),
+		"duration_ms": duration.Milliseconds(),
+		"user_ms":     state.UserTime().Milliseconds(),
+		"system_ms":   state.SystemTime().Milliseconds(),
+	}
+
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Kwargs["signal"] = status.Signal().String()
+	}
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		result.Kwargs["max_rss_kb"] = usage.Maxrss
+	}
+
+	return result
+}
+
+// Exec runs a command on a desktop through its exec procedure, copying the
+// command's stdout and stderr to the given writers as they arrive.
+func Exec(session *xconn.Session, procedure string, command []string, options ExecOptions, stdout,
+	stderr io.Writer) (*ExecResult, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("no command given")
+	}
+
+	kwargs := map[string]any{}
+	if options.Stdin != nil {
+		kwargs["stdin"] = options.Stdin
+	}
+	if options.Timeout > 0 {
+		kwargs["timeout_ms"] = options.Timeout.Milliseconds()
+	}
+	if options.Dir != "" {
+		kwargs["cwd"] = options.Dir
+	}
+	if len(options.Env) > 0 {
+		env := make(map[string]any, len(options.Env))
+		for name, value := range options.Env {
+			env[name] = value
+		}
+		kwargs["env"] = env
+	}
+
+	args := make([]any, 0, len(command))
+	for _, arg := range command {
+		args = append(args, arg)
+	}
+
+	var writeErr error
+	response := session.Call(procedure).Args(args...).Kwargs(kwargs).
+		ProgressReceiver(func(result *xconn.ProgressResult) {
+			chunk, err := result.ArgBytes(0)
+			if err != nil || writeErr != nil {
+				return
+			}
+
+			out := stdout
+			if result.KwargStringOr("stream", "stdout") == "stderr" {
+				out = stderr
+			}
+			_, writeErr = out.Write(chunk)
+		}).Do()
+	if response.Err != nil {
+		return nil, fmt.Errorf("exec error: %w", response.Err)
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	exitCode, err := response.KwargInt64("exit_code")
+	if err != nil {
+		return nil, fmt.Errorf("exec result has no exit code: %w", err)
+	}
+
+	return &ExecResult{
+		ExitCode:   int(exitCode),
+		Signal:     response.KwargStringOr("signal", ""),
+		TimedOut:   response.KwargBoolOr("timed_out", false),
+		Duration:   time.Duration(response.KwargInt64Or("duration_ms", 0)) * time.Millisecond,
+		UserTime:   time.Duration(response.KwargInt64Or("user_ms", 0)) * time.Millisecond,
+		SystemTime: time.Duration(response.KwargInt64Or("system_ms", 0)) * time.Millisecond,
+		MaxRSS:     response.KwargInt64Or("max_rss_kb", 0),
+	}, nil
+}
@@ -0,0 +1,90 @@
+package deskconn_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+func TestExec(t *testing.T) {
+	caller := setupShellDesktop(t, deskconn.ShellConfig{
+		AllowedEnv:  []string{"GREETING"},
+		AllowedDirs: []string{os.TempDir()},
+	})
+
+	t.Run("Streams", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		result, err := deskconn.Exec(caller, deskconn.ProcedureExec,
+			[]string{"/bin/sh", "-c", "echo out; echo err >&2; exit 3"}, deskconn.ExecOptions{}, &stdout, &stderr)
+		require.NoError(t, err)
+		require.Equal(t, 3, result.ExitCode)
+		require.False(t, result.TimedOut)
+		require.Empty(t, result.Signal)
+		require.Equal(t, "out\n", stdout.String())
+		require.Equal(t, "err\n", stderr.String())
+	})
+
+	t.Run("Stdin", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		dir := t.TempDir()
+		result, err := deskconn.Exec(caller, deskconn.ProcedureExec, []string{"/bin/sh", "-c", "pwd; cat; echo $GREETING"},
+			deskconn.ExecOptions{
+				Stdin: []byte("from stdin\n"),
+				Dir:   dir,
+				Env:   map[string]string{"GREETING": "hello"},
+			}, &stdout, &stderr)
+		require.NoError(t, err)
+		require.Zero(t, result.ExitCode)
+		require.Equal(t, dir+"\nfrom stdin\nhello\n", stdout.String())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		result, err := deskconn.Exec(caller, deskconn.ProcedureExec, []string{"/bin/sh", "-c", "sleep 10 & wait"},
+			deskconn.ExecOptions{Timeout: 200 * time.Millisecond}, &stdout, &stderr)
+		require.NoError(t, err)
+		require.True(t, result.TimedOut)
+		require.Equal(t, -1, result.ExitCode)
+		require.Equal(t, "killed", result.Signal)
+		require.Less(t, result.Duration, 5*time.Second)
+	})
+
+	t.Run("WithoutProgress", func(t *testing.T) {
+		response := caller.Call(deskconn.ProcedureExec).
+			Args("/bin/sh", "-c", "echo out; echo err >&2").Do()
+		require.NoError(t, response.Err)
+		require.Equal(t, int64(0), response.KwargInt64Or("exit_code", -1))
+		require.Equal(t, []byte("out\n"), response.KwargBytesOr("stdout", nil))
+		require.Equal(t, []byte("err\n"), response.KwargBytesOr("stderr", nil))
+	})
+
+	t.Run("MissingCommand", func(t *testing.T) {
+		response := caller.Call(deskconn.ProcedureExec).Do()
+		require.ErrorContains(t, response.Err, deskconn.ErrInvalidArgument)
+	})
+}
+
+func TestExecAllowedCommands(t *testing.T) {
+	caller := setupShellDesktop(t, deskconn.ShellConfig{Command: "/bin/sh", AllowedCommands: []string{"/bin/echo"}})
+
+	var stdout, stderr bytes.Buffer
+	result, err := deskconn.Exec(caller, deskconn.ProcedureExec, []string{"/bin/echo", "allowed"},
+		deskconn.ExecOptions{}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Zero(t, result.ExitCode)
+	require.Equal(t, "allowed\n", stdout.String())
+
+	_, err = deskconn.Exec(caller, deskconn.ProcedureExec, []string{"/usr/bin/env"}, deskconn.ExecOptions{},
+		&stdout, &stderr)
+	require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+
+	// The default shell is not allowed unless it is listed.
+	_, err = deskconn.Exec(caller, deskconn.ProcedureExec, []string{"/bin/sh", "-c", "true"}, deskconn.ExecOptions{},
+		&stdout, &stderr)
+	require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+}
@@ -1,7 +1,8 @@
 package deskconn
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,59 +11,104 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func EnsureCredentials() (*Credentials, error) {
-	credFilePath, err := credentialsFilePath()
+// EnsureCredentials waits until the desktop is attached to the profile and
+// returns the profile along with its credentials, their private key unlocked.
+func EnsureCredentials(profileName string) (*Profile, *Credentials, error) {
+	path, err := ProfilePath(profileName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if _, err := os.Stat(credFilePath); err != nil {
-		watcher, err := fsnotify.NewWatcher()
-		if err != nil {
-			return nil, fmt.Errorf("failed to create watcher: %w", err)
-		}
-		defer watcher.Close()
-
-		if err := watcher.Add(filepath.Dir(credFilePath)); err != nil {
-			return nil, fmt.Errorf("failed to add watcher: %w", err)
-		}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
 
-		log.Println("Waiting for credentials file...")
+	// The profile is watched before it is read, so that an attach in between
+	// is not missed.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return nil, nil, fmt.Errorf("failed to add watcher: %w", err)
+	}
 
-		for event := range watcher.Events {
-			if event.Name != credFilePath {
-				continue
+	waiting := false
+	for {
+		profile, err := LoadProfile(profileName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if profile.Credentials != nil {
+			// Credentials of older versions move into the default profile,
+			// which is then watched for changes.
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				if err := SaveProfile(profile); err != nil {
+					return nil, nil, err
+				}
 			}
-
-			if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
-				log.Println("Desktop successfully attached to cloud")
-				break
+			if waiting {
+				log.Printf("Desktop successfully attached to cloud of profile %s", profileName)
+			}
+			creds := *profile.Credentials
+			if err := unlockPrivateKey(&creds, KeyOptions{}); err != nil {
+				return nil, nil, err
 			}
+			return profile, &creds, nil
 		}
-	}
 
-	data, err := os.ReadFile(credFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+		if !waiting {
+			log.Printf("Waiting for desktop to be attached to profile %s...", profileName)
+			waiting = true
+		}
+		if err := waitProfileWritten(watcher, path); err != nil {
+			return nil, nil, err
+		}
 	}
+}
 
-	var creds Credentials
-	if err := json.Unmarshal(data, &creds); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal credentials: %w", err)
+func waitProfileWritten(watcher *fsnotify.Watcher, path string) error {
+	for event := range watcher.Events {
+		if event.Name == path && event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+			return nil
+		}
 	}
-
-	return &creds, nil
+	return fmt.Errorf("profile watcher closed")
 }
 
-func credentialsFilePath() (string, error) {
-	homedir, err := os.UserHomeDir()
+// WaitCredentialsChanged blocks until the profile is replaced, as it is when
+// the key is rotated or the desktop detached, or removed, or until ctx is
+// done.
+func WaitCredentialsChanged(ctx context.Context, profileName string) error {
+	path, err := ProfilePath(profileName)
 	if err != nil {
-		return "", fmt.Errorf("failed to get user home dir: %w", err)
+		return err
 	}
 
-	credFilePath := filepath.Join(homedir, ".deskconn/credentials.env")
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
 
-	_ = os.MkdirAll(filepath.Dir(credFilePath), 0755)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to add watcher: %w", err)
+	}
 
-	return credFilePath, nil
+	// The profile may have been removed before it was watched.
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("profile watcher closed")
+			}
+			if event.Name == path && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
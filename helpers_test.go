@@ -0,0 +1,109 @@
+package deskconn_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+// setupConfigDir points the home and config directories of the test to empty
+// ones and returns the directory profiles are stored in.
+func setupConfigDir(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+
+	dir, err := deskconn.ProfilesDir()
+	require.NoError(t, err)
+	return dir
+}
+
+func saveCredentials(t *testing.T, name string, creds deskconn.Credentials) string {
+	require.NoError(t, deskconn.SaveProfile(&deskconn.Profile{Name: name, Credentials: &creds}))
+	path, err := deskconn.ProfilePath(name)
+	require.NoError(t, err)
+	return path
+}
+
+func TestWaitCredentialsChanged(t *testing.T) {
+	setupConfigDir(t)
+	profilePath := saveCredentials(t, "staging", deskconn.Credentials{AuthID: "machine", PrivateKey: "old"})
+
+	_, creds, err := deskconn.EnsureCredentials("staging")
+	require.NoError(t, err)
+	require.Equal(t, "old", creds.PrivateKey)
+	require.False(t, creds.KeyExpired())
+
+	wait := func(change func()) {
+		changed := make(chan error, 1)
+		go func() { changed <- deskconn.WaitCredentialsChanged(context.Background(), "staging") }()
+		// Give the watcher time to start, a change before that is missed.
+		time.Sleep(100 * time.Millisecond)
+		change()
+
+		select {
+		case err := <-changed:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("credentials change not noticed")
+		}
+	}
+
+	t.Run("Rotated", func(t *testing.T) {
+		wait(func() {
+			saveCredentials(t, "staging", deskconn.Credentials{
+				AuthID:     "machine",
+				PrivateKey: "new",
+				CreatedAt:  time.Now().Add(-deskconn.KeyMaxAge - time.Hour),
+			})
+		})
+
+		_, creds, err := deskconn.EnsureCredentials("staging")
+		require.NoError(t, err)
+		require.Equal(t, "new", creds.PrivateKey)
+		require.True(t, creds.KeyExpired())
+	})
+
+	t.Run("Removed", func(t *testing.T) {
+		wait(func() { require.NoError(t, os.Remove(profilePath)) })
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		saveCredentials(t, "staging", deskconn.Credentials{AuthID: "machine"})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, deskconn.WaitCredentialsChanged(ctx, "staging"), context.Canceled)
+	})
+}
+
+func TestEnsureCredentialsWaitsForAttach(t *testing.T) {
+	setupConfigDir(t)
+	// A profile that is configured but not attached yet.
+	require.NoError(t, deskconn.SaveProfile(&deskconn.Profile{Name: "staging", URI: "ws://staging/ws"}))
+
+	var creds *deskconn.Credentials
+	attached := make(chan error, 1)
+	go func() {
+		var err error
+		_, creds, err = deskconn.EnsureCredentials("staging")
+		attached <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, attached)
+	saveCredentials(t, "staging", deskconn.Credentials{AuthID: "machine", PrivateKey: "private"})
+
+	select {
+	case err := <-attached:
+		require.NoError(t, err)
+		require.Equal(t, "private", creds.PrivateKey)
+	case <-time.After(5 * time.Second):
+		t.Fatal("attach not noticed")
+	}
+}
@@ -0,0 +1,95 @@
+package deskconn
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type idleProvider struct {
+	service string
+	path    dbus.ObjectPath
+	iface   string
+	method  string
+	unit    time.Duration
+}
+
+func idleProviders() []*idleProvider {
+	return []*idleProvider{
+		{"org.gnome.Mutter.IdleMonitor", "/org/gnome/Mutter/IdleMonitor/Core", "org.gnome.Mutter.IdleMonitor",
+			"GetIdletime", time.Millisecond},
+		{"org.freedesktop.ScreenSaver", "/org/freedesktop/ScreenSaver", "org.freedesktop.ScreenSaver",
+			"GetSessionIdleTime", time.Second},
+	}
+}
+
+type inhibitProvider struct {
+	service   string
+	path      dbus.ObjectPath
+	iface     string
+	inhibit   string
+	uninhibit string
+}
+
+func inhibitProviders() []*inhibitProvider {
+	return []*inhibitProvider{
+		{"org.freedesktop.ScreenSaver", "/org/freedesktop/ScreenSaver", "org.freedesktop.ScreenSaver", "Inhibit",
+			"UnInhibit"},
+		{"org.gnome.ScreenSaver", "/org/gnome/ScreenSaver", "org.gnome.ScreenSaver", "Inhibit", "UnInhibit"},
+	}
+}
+
+// IdleTime returns how long the user has not touched keyboard or mouse.
+func (s *Screen) IdleTime() (time.Duration, error) {
+	for _, p := range idleProviders() {
+		call := s.sessionBus.Object(p.service, p.path).Call(p.iface+"."+p.method, 0)
+		if call.Err != nil {
+			continue
+		}
+
+		if len(call.Body) == 0 {
+			continue
+		}
+
+		switch idle := call.Body[0].(type) {
+		case uint64:
+			return time.Duration(idle) * p.unit, nil // #nosec G115
+		case uint32:
+			return time.Duration(idle) * p.unit, nil
+		}
+	}
+
+	return 0, fmt.Errorf("idle time not available")
+}
+
+// InhibitIdle keeps the session from going idle until the returned release
+// function is called. The screensaver inhibitors are tried first, with a
+// logind idle inhibitor lock as the fallback.
+func (s *Screen) InhibitIdle(reason string) (func() error, error) {
+	for _, p := range inhibitProviders() {
+		obj := s.sessionBus.Object(p.service, p.path)
+
+		var cookie uint32
+		if err := obj.Call(p.iface+"."+p.inhibit, 0, "deskconn", reason).Store(&cookie); err != nil {
+			continue
+		}
+
+		return func() error {
+			return obj.Call(p.iface+"."+p.uninhibit, 0, cookie).Err
+		}, nil
+	}
+
+	obj := s.systemBus.Object(logindService, logindManagerPath)
+
+	var fd dbus.UnixFD
+	err := obj.Call(logindManagerIface+".Inhibit", 0, "idle", "deskconn", reason, "block").Store(&fd)
+	if err != nil {
+		return nil, fmt.Errorf("idle inhibit not available: %w", err)
+	}
+
+	// logind holds the inhibitor lock for as long as the descriptor is open
+	lock := os.NewFile(uintptr(fd), "idle-inhibitor")
+	return lock.Close, nil
+}
@@ -0,0 +1,88 @@
+package deskconn_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+type fakeIdleService struct {
+	cookies map[uint32]string
+	next    uint32
+	mu      sync.Mutex
+}
+
+func (f *fakeIdleService) GetSessionIdleTime() (uint32, *dbus.Error) {
+	return 42, nil
+}
+
+func (f *fakeIdleService) Inhibit(_, reason string) (uint32, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.next++
+	f.cookies[f.next] = reason
+	return f.next, nil
+}
+
+func (f *fakeIdleService) UnInhibit(cookie uint32) *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.cookies, cookie)
+	return nil
+}
+
+func (f *fakeIdleService) Inhibitors() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.cookies)
+}
+
+func exportFakeIdleService(t *testing.T, conn *dbus.Conn) *fakeIdleService {
+	t.Helper()
+
+	fake := &fakeIdleService{cookies: make(map[uint32]string)}
+	require.NoError(t, conn.Export(fake, "/org/freedesktop/ScreenSaver", "org.freedesktop.ScreenSaver"))
+	_, err := conn.RequestName("org.freedesktop.ScreenSaver", dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+
+	return fake
+}
+
+func TestIdleTime(t *testing.T) {
+	address := startPrivateBus(t)
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	_, err := s.IdleTime()
+	require.EqualError(t, err, "idle time not available")
+
+	exportFakeIdleService(t, connectPrivateBus(t, address))
+
+	idle, err := s.IdleTime()
+	require.NoError(t, err)
+	require.Equal(t, 42*time.Second, idle)
+}
+
+func TestInhibitIdle(t *testing.T) {
+	address := startPrivateBus(t)
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	_, err := s.InhibitIdle("test")
+	require.ErrorContains(t, err, "idle inhibit not available")
+
+	fake := exportFakeIdleService(t, connectPrivateBus(t, address))
+
+	release, err := s.InhibitIdle("test")
+	require.NoError(t, err)
+	require.Equal(t, 1, fake.Inhibitors())
+
+	require.NoError(t, release())
+	require.Equal(t, 0, fake.Inhibitors())
+}
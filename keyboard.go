@@ -0,0 +1,103 @@
+package deskconn
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var LedsBasePath = "/sys/class/leds" //nolint: gochecknoglobals
+
+const (
+	upowerService      = "org.freedesktop.UPower"
+	upowerKbdPath      = "/org/freedesktop/UPower/KbdBacklight"
+	upowerKbdIface     = "org.freedesktop.UPower.KbdBacklight"
+	kbdBacklightSuffix = "::kbd_backlight"
+)
+
+// detectKeyboardBacklight prefers UPower, which works without privileges,
+// and falls back to the first kbd_backlight led found in sysfs.
+func (s *Screen) detectKeyboardBacklight() {
+	var max int32
+	obj := s.systemBus.Object(upowerService, upowerKbdPath)
+	if err := obj.Call(upowerKbdIface+".GetMaxBrightness", 0).Store(&max); err == nil && max > 0 {
+		s.kbdUPower = true
+		return
+	}
+
+	entries, _ := os.ReadDir(LedsBasePath)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), kbdBacklightSuffix) {
+			continue
+		}
+
+		full := filepath.Join(LedsBasePath, e.Name())
+		max, err := readSysfsInt(filepath.Join(full, "max_brightness"))
+		if err != nil {
+			continue
+		}
+
+		s.kbdLed = &backlight{name: e.Name(), dir: full, max: max}
+		return
+	}
+}
+
+func (s *Screen) GetKeyboardBrightness() (int, error) {
+	switch {
+	case s.kbdUPower:
+		obj := s.systemBus.Object(upowerService, upowerKbdPath)
+
+		var current, max int32
+		if err := obj.Call(upowerKbdIface+".GetMaxBrightness", 0).Store(&max); err != nil {
+			return 0, err
+		}
+		if err := obj.Call(upowerKbdIface+".GetBrightness", 0).Store(&current); err != nil {
+			return 0, err
+		}
+
+		return (&backlight{max: int(max)}).toPercent(int(current)), nil
+	case s.kbdLed != nil:
+		current, err := s.kbdLed.current()
+		if err != nil {
+			return 0, err
+		}
+
+		return s.kbdLed.toPercent(current), nil
+	default:
+		return 0, fmt.Errorf("keyboard backlight not available")
+	}
+}
+
+func (s *Screen) SetKeyboardBrightness(percent int) error {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	switch {
+	case s.kbdUPower:
+		obj := s.systemBus.Object(upowerService, upowerKbdPath)
+
+		var max int32
+		if err := obj.Call(upowerKbdIface+".GetMaxBrightness", 0).Store(&max); err != nil {
+			return err
+		}
+
+		value := (percent * int(max)) / 100
+		return obj.Call(upowerKbdIface+".SetBrightness", 0, int32(value)).Err // #nosec G115
+	case s.kbdLed != nil:
+		value := (percent * s.kbdLed.max) / 100
+		if value < 0 || value > math.MaxUint32 {
+			return fmt.Errorf("brightness value out of uint32 range: %d", value)
+		}
+
+		obj := s.systemBus.Object(logindService, logindAutoSession)
+		return obj.Call(logindSessionIface+".SetBrightness", 0, "leds", s.kbdLed.name, uint32(value)).Err
+	default:
+		return fmt.Errorf("keyboard backlight not available")
+	}
+}
@@ -0,0 +1,103 @@
+package deskconn_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+type fakeKbdBacklight struct {
+	brightness atomic.Int32
+}
+
+func (f *fakeKbdBacklight) GetMaxBrightness() (int32, *dbus.Error) {
+	return 3, nil
+}
+
+func (f *fakeKbdBacklight) GetBrightness() (int32, *dbus.Error) {
+	return f.brightness.Load(), nil
+}
+
+func (f *fakeKbdBacklight) SetBrightness(value int32) *dbus.Error {
+	f.brightness.Store(value)
+	return nil
+}
+
+func mockLedsDir(t *testing.T) string {
+	t.Helper()
+
+	tmp := t.TempDir()
+
+	dev := filepath.Join(tmp, "tpacpi::kbd_backlight")
+	require.NoError(t, os.Mkdir(dev, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dev, "max_brightness"), []byte("2"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dev, "brightness"), []byte("1"), 0600))
+
+	other := filepath.Join(tmp, "input3::capslock")
+	require.NoError(t, os.Mkdir(other, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(other, "max_brightness"), []byte("1"), 0600))
+
+	old := deskconn.LedsBasePath
+	t.Cleanup(func() { deskconn.LedsBasePath = old })
+	deskconn.LedsBasePath = tmp
+
+	return tmp
+}
+
+func TestKeyboardBrightnessUPower(t *testing.T) {
+	mockLedsDir(t)
+	address := startPrivateBus(t)
+
+	upowerConn := connectPrivateBus(t, address)
+	fake := &fakeKbdBacklight{}
+	fake.brightness.Store(1)
+	require.NoError(t, upowerConn.Export(fake, "/org/freedesktop/UPower/KbdBacklight",
+		"org.freedesktop.UPower.KbdBacklight"))
+	_, err := upowerConn.RequestName("org.freedesktop.UPower", dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	brightness, err := s.GetKeyboardBrightness()
+	require.NoError(t, err)
+	require.Equal(t, 33, brightness)
+
+	require.NoError(t, s.SetKeyboardBrightness(100))
+	require.Equal(t, int32(3), fake.brightness.Load())
+
+	brightness, err = s.GetKeyboardBrightness()
+	require.NoError(t, err)
+	require.Equal(t, 100, brightness)
+}
+
+func TestKeyboardBrightnessSysfs(t *testing.T) {
+	mockLedsDir(t)
+	address := startPrivateBus(t)
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	brightness, err := s.GetKeyboardBrightness()
+	require.NoError(t, err)
+	require.Equal(t, 50, brightness)
+}
+
+func TestKeyboardBrightnessNoDevice(t *testing.T) {
+	old := deskconn.LedsBasePath
+	t.Cleanup(func() { deskconn.LedsBasePath = old })
+	deskconn.LedsBasePath = t.TempDir()
+
+	address := startPrivateBus(t)
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	_, err := s.GetKeyboardBrightness()
+	require.EqualError(t, err, "keyboard backlight not available")
+
+	err = s.SetKeyboardBrightness(10)
+	require.EqualError(t, err, "keyboard backlight not available")
+}
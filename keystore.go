@@ -0,0 +1,237 @@
+package deskconn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KeyStorage says where the private key of the desktop is kept.
+type KeyStorage string
+
+const (
+	// KeyStoragePlain keeps the private key as hex in the credentials file.
+	KeyStoragePlain KeyStorage = "plain"
+	// KeyStoragePassphrase keeps the private key in the credentials file,
+	// encrypted with a key derived from a passphrase.
+	KeyStoragePassphrase KeyStorage = "passphrase"
+	// KeyStorageSecretService keeps the private key in the keyring of the
+	// user through the Secret Service API.
+	KeyStorageSecretService KeyStorage = "secret-service"
+
+	keyKDF = "argon2id"
+	// Argon2id parameters as recommended by RFC 9106 for memory constrained
+	// environments.
+	keyKDFTime    = 3
+	keyKDFMemory  = 64 * 1024
+	keyKDFThreads = 4
+)
+
+// ErrPassphraseRequired is returned when the private key is encrypted and no
+// passphrase was given to unlock it.
+var ErrPassphraseRequired = errors.New(
+	"private key is encrypted, set DESKCONN_KEY_PASSPHRASE or DESKCONN_KEY_PASSPHRASE_FILE")
+
+// ParseKeyStorage checks the name of a key storage.
+func ParseKeyStorage(name string) (KeyStorage, error) {
+	switch storage := KeyStorage(name); storage {
+	case KeyStoragePlain, KeyStoragePassphrase, KeyStorageSecretService:
+		return storage, nil
+	default:
+		return "", fmt.Errorf("unknown key storage %q, expected %s, %s or %s", name, KeyStoragePlain,
+			KeyStoragePassphrase, KeyStorageSecretService)
+	}
+}
+
+// EncryptedKey is a private key encrypted with AES-256-GCM, under a key
+// derived from a passphrase with Argon2id.
+type EncryptedKey struct {
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// KeyOptions say how to unlock the stored private key of the desktop.
+type KeyOptions struct {
+	// Passphrase unlocks a key in KeyStoragePassphrase. When empty it is
+	// taken from the environment, see KeyPassphrase.
+	Passphrase string
+}
+
+func (o KeyOptions) passphrase() (string, error) {
+	if o.Passphrase != "" {
+		return o.Passphrase, nil
+	}
+	return KeyPassphrase()
+}
+
+// KeyPassphrase returns the passphrase protecting the private key, read from
+// the file named by DESKCONN_KEY_PASSPHRASE_FILE or else from
+// DESKCONN_KEY_PASSPHRASE.
+func KeyPassphrase() (string, error) {
+	if path, ok := os.LookupEnv("DESKCONN_KEY_PASSPHRASE_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if passphrase, ok := os.LookupEnv("DESKCONN_KEY_PASSPHRASE"); ok {
+		return passphrase, nil
+	}
+
+	return "", ErrPassphraseRequired
+}
+
+// sealPrivateKey encrypts a private key with a passphrase. The auth id is
+// bound to the ciphertext, so the key cannot be moved to other credentials.
+func sealPrivateKey(privateKey, passphrase, authID string) (*EncryptedKey, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+
+	sealed := &EncryptedKey{
+		KDF:     keyKDF,
+		Salt:    make([]byte, 16),
+		Time:    keyKDFTime,
+		Memory:  keyKDFMemory,
+		Threads: keyKDFThreads,
+	}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := sealed.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return nil, err
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, []byte(privateKey), []byte(authID))
+
+	return sealed, nil
+}
+
+func (e *EncryptedKey) open(passphrase, authID string) (string, error) {
+	if e.KDF != keyKDF {
+		return "", fmt.Errorf("unsupported key derivation %q", e.KDF)
+	}
+
+	aead, err := e.cipher(passphrase)
+	if err != nil {
+		return "", err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return "", fmt.Errorf("invalid nonce in encrypted private key")
+	}
+
+	privateKey, err := aead.Open(nil, e.Nonce, e.Ciphertext, []byte(authID))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt private key: wrong passphrase")
+	}
+	return string(privateKey), nil
+}
+
+func (e *EncryptedKey) cipher(passphrase string) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), e.Salt, e.Time, e.Memory, e.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// unlockPrivateKey fills in the private key of credentials read from disk,
+// from wherever their key storage keeps it.
+func unlockPrivateKey(creds *Credentials, opts KeyOptions) error {
+	switch creds.KeyStorage {
+	case "", KeyStoragePlain:
+		if creds.PrivateKey == "" {
+			return fmt.Errorf("credentials file has no private key")
+		}
+		return nil
+	case KeyStoragePassphrase:
+		if creds.EncryptedKey == nil {
+			return fmt.Errorf("credentials file has no encrypted private key")
+		}
+		passphrase, err := opts.passphrase()
+		if err != nil {
+			return err
+		}
+		creds.PrivateKey, err = creds.EncryptedKey.open(passphrase, creds.AuthID)
+		return err
+	case KeyStorageSecretService:
+		secrets, err := openSecretService()
+		if err != nil {
+			return err
+		}
+		defer secrets.close()
+
+		creds.PrivateKey, err = secrets.lookup(creds.AuthID, creds.PublicKey)
+		return err
+	default:
+		return fmt.Errorf("unknown key storage %q", creds.KeyStorage)
+	}
+}
+
+// sealCredentials returns credentials as they are written to disk, with the
+// private key moved to their key storage.
+func sealCredentials(creds Credentials, passphrase string) (Credentials, error) {
+	switch creds.KeyStorage {
+	case "", KeyStoragePlain:
+		creds.KeyStorage = ""
+		creds.EncryptedKey = nil
+		return creds, nil
+	case KeyStoragePassphrase:
+		sealed, err := sealPrivateKey(creds.PrivateKey, passphrase, creds.AuthID)
+		if err != nil {
+			return Credentials{}, err
+		}
+		creds.EncryptedKey = sealed
+	case KeyStorageSecretService:
+		secrets, err := openSecretService()
+		if err != nil {
+			return Credentials{}, err
+		}
+		defer secrets.close()
+
+		if err := secrets.store(creds.AuthID, creds.PublicKey, creds.PrivateKey); err != nil {
+			return Credentials{}, err
+		}
+		creds.EncryptedKey = nil
+	default:
+		return Credentials{}, fmt.Errorf("unknown key storage %q", creds.KeyStorage)
+	}
+
+	creds.PrivateKey = ""
+	return creds, nil
+}
+
+// forgetPrivateKey removes a private key that is no longer used from the key
+// storage of the credentials it belonged to.
+func forgetPrivateKey(creds *Credentials) error {
+	if creds.KeyStorage != KeyStorageSecretService {
+		return nil
+	}
+
+	secrets, err := openSecretService()
+	if err != nil {
+		return err
+	}
+	defer secrets.close()
+
+	return secrets.remove(creds.AuthID, creds.PublicKey)
+}
@@ -0,0 +1,213 @@
+package deskconn_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+type fakeSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+type fakeSecretItem struct {
+	service    *fakeSecretService
+	path       dbus.ObjectPath
+	attributes map[string]string
+	secret     []byte
+}
+
+func (i *fakeSecretItem) GetSecret(session dbus.ObjectPath) (fakeSecret, *dbus.Error) {
+	return fakeSecret{Session: session, Value: i.secret, ContentType: "text/plain"}, nil
+}
+
+func (i *fakeSecretItem) Delete() (dbus.ObjectPath, *dbus.Error) {
+	i.service.Lock()
+	defer i.service.Unlock()
+
+	delete(i.service.items, i.path)
+	_ = i.service.conn.Export(nil, i.path, "org.freedesktop.Secret.Item")
+	return "/", nil
+}
+
+// fakeSecretService keeps secrets in memory, implementing as much of the
+// Secret Service API as storing the private key needs.
+type fakeSecretService struct {
+	conn  *dbus.Conn
+	items map[dbus.ObjectPath]*fakeSecretItem
+	next  int
+	sync.Mutex
+}
+
+func (f *fakeSecretService) OpenSession(_ string, _ dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	return dbus.MakeVariant(""), "/org/freedesktop/secrets/session/1", nil
+}
+
+func (f *fakeSecretService) SearchItems(attributes map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath,
+	*dbus.Error) {
+	f.Lock()
+	defer f.Unlock()
+
+	found := []dbus.ObjectPath{}
+	for path, item := range f.items {
+		if maps.Equal(item.attributes, attributes) {
+			found = append(found, path)
+		}
+	}
+	return found, []dbus.ObjectPath{}, nil
+}
+
+func (f *fakeSecretService) CreateItem(properties map[string]dbus.Variant, secret fakeSecret, replace bool) (
+	dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	attributes, ok := properties["org.freedesktop.Secret.Item.Attributes"].Value().(map[string]string)
+	if !ok {
+		return "", "", dbus.MakeFailedError(fmt.Errorf("missing attributes"))
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for path, item := range f.items {
+		if replace && maps.Equal(item.attributes, attributes) {
+			item.secret = secret.Value
+			return path, "/", nil
+		}
+	}
+
+	f.next++
+	path := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/secrets/collection/login/%d", f.next))
+	item := &fakeSecretItem{service: f, path: path, attributes: attributes, secret: secret.Value}
+	if err := f.conn.Export(item, path, "org.freedesktop.Secret.Item"); err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+	f.items[path] = item
+	return path, "/", nil
+}
+
+func (f *fakeSecretService) Secrets() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	secrets := make([]string, 0, len(f.items))
+	for _, item := range f.items {
+		secrets = append(secrets, string(item.secret))
+	}
+	return secrets
+}
+
+// exportFakeSecretService claims org.freedesktop.secrets on a private bus and
+// makes it the session bus of the test.
+func exportFakeSecretService(t *testing.T) *fakeSecretService {
+	t.Helper()
+
+	address := startPrivateBus(t)
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+	conn := connectPrivateBus(t, address)
+
+	fake := &fakeSecretService{conn: conn, items: make(map[dbus.ObjectPath]*fakeSecretItem)}
+	require.NoError(t, conn.Export(fake, "/org/freedesktop/secrets", "org.freedesktop.Secret.Service"))
+	require.NoError(t, conn.Export(fake, "/org/freedesktop/secrets/aliases/default",
+		"org.freedesktop.Secret.Collection"))
+	_, err := conn.RequestName("org.freedesktop.secrets", dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+
+	return fake
+}
+
+// setupPlainCredentials writes credentials as older versions did, with the
+// private key in plaintext, and returns the path of the profile.
+func setupPlainCredentials(t *testing.T) string {
+	setupConfigDir(t)
+	return saveCredentials(t, deskconn.DefaultProfile, deskconn.Credentials{
+		AuthID:     "machine",
+		PublicKey:  "public",
+		PrivateKey: "private",
+	})
+}
+
+func readStoredCredentials(t *testing.T, path string) map[string]any {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	stored := struct {
+		Credentials map[string]any `json:"credentials"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &stored))
+	return stored.Credentials
+}
+
+func TestMigrateKey(t *testing.T) {
+	t.Run("Passphrase", func(t *testing.T) {
+		credFilePath := setupPlainCredentials(t)
+
+		require.NoError(t, deskconn.MigrateKey(deskconn.DefaultProfile, deskconn.KeyStoragePassphrase, "correct horse",
+			deskconn.KeyOptions{}))
+		stored := readStoredCredentials(t, credFilePath)
+		require.NotContains(t, stored, "private_key")
+		require.Equal(t, "passphrase", stored["key_storage"])
+
+		_, _, err := deskconn.EnsureCredentials(deskconn.DefaultProfile)
+		require.ErrorIs(t, err, deskconn.ErrPassphraseRequired)
+
+		// A passphrase handed over directly needs nothing in the environment.
+		err = deskconn.MigrateKey(deskconn.DefaultProfile, deskconn.KeyStoragePassphrase, "correct horse",
+			deskconn.KeyOptions{Passphrase: "wrong"})
+		require.ErrorContains(t, err, "wrong passphrase")
+		require.NoError(t, deskconn.MigrateKey(deskconn.DefaultProfile, deskconn.KeyStoragePassphrase, "correct horse",
+			deskconn.KeyOptions{Passphrase: "correct horse"}))
+
+		t.Setenv("DESKCONN_KEY_PASSPHRASE", "wrong")
+		_, _, err = deskconn.EnsureCredentials(deskconn.DefaultProfile)
+		require.ErrorContains(t, err, "wrong passphrase")
+
+		passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+		require.NoError(t, os.WriteFile(passphraseFile, []byte("correct horse\n"), 0600))
+		t.Setenv("DESKCONN_KEY_PASSPHRASE_FILE", passphraseFile)
+		_, creds, err := deskconn.EnsureCredentials(deskconn.DefaultProfile)
+		require.NoError(t, err)
+		require.Equal(t, "private", creds.PrivateKey)
+
+		require.NoError(t, deskconn.MigrateKey(deskconn.DefaultProfile, deskconn.KeyStoragePlain, "", deskconn.KeyOptions{}))
+		require.Equal(t, "private", readStoredCredentials(t, credFilePath)["private_key"])
+	})
+
+	t.Run("SecretService", func(t *testing.T) {
+		credFilePath := setupPlainCredentials(t)
+		fake := exportFakeSecretService(t)
+
+		require.NoError(t, deskconn.MigrateKey(deskconn.DefaultProfile, deskconn.KeyStorageSecretService, "",
+			deskconn.KeyOptions{}))
+		stored := readStoredCredentials(t, credFilePath)
+		require.NotContains(t, stored, "private_key")
+		require.Equal(t, "secret-service", stored["key_storage"])
+		require.Equal(t, []string{"private"}, fake.Secrets())
+
+		_, creds, err := deskconn.EnsureCredentials(deskconn.DefaultProfile)
+		require.NoError(t, err)
+		require.Equal(t, "private", creds.PrivateKey)
+
+		require.NoError(t, deskconn.MigrateKey(deskconn.DefaultProfile, deskconn.KeyStoragePlain, "", deskconn.KeyOptions{}))
+		require.Equal(t, "private", readStoredCredentials(t, credFilePath)["private_key"])
+		require.Empty(t, fake.Secrets())
+	})
+
+	t.Run("SecretServiceUnavailable", func(t *testing.T) {
+		credFilePath := setupPlainCredentials(t)
+		t.Setenv("DBUS_SESSION_BUS_ADDRESS", startPrivateBus(t))
+
+		err := deskconn.MigrateKey(deskconn.DefaultProfile, deskconn.KeyStorageSecretService, "", deskconn.KeyOptions{})
+		require.ErrorContains(t, err, "secret service not available")
+		require.Equal(t, "private", readStoredCredentials(t, credFilePath)["private_key"])
+	})
+}
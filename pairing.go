@@ -0,0 +1,102 @@
+package deskconn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	ProcedureDeskconnPairingCreate = "io.xconn.deskconn.desktop.pairing.create"
+
+	// DefaultPairingCodeTTL is how long a pairing code stays valid unless
+	// asked otherwise.
+	DefaultPairingCodeTTL = 15 * time.Minute
+
+	pairingCodeLength = 8
+)
+
+// PairingCode is a short-lived, one-time code with which a desktop attaches
+// to the account that created it, without the password of that account.
+type PairingCode struct {
+	Code      string
+	ExpiresAt time.Time
+}
+
+// CreatePairingCode asks the cloud for a pairing code valid for ttl, over a
+// session authenticated as the account the desktop is to be attached to.
+func CreatePairingCode(session *xconn.Session, ttl time.Duration) (*PairingCode, error) {
+	callResp := session.Call(ProcedureDeskconnPairingCreate).Kwarg("ttl_ms", ttl.Milliseconds()).Do()
+	if callResp.Err != nil {
+		return nil, fmt.Errorf("failed to create pairing code: %w", callResp.Err)
+	}
+
+	code, err := callResp.ArgString(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pairing code from cloud: %w", err)
+	}
+	code, err = ParsePairingCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if ms, err := callResp.KwargInt64("expires_at_ms"); err == nil {
+		expiresAt = time.UnixMilli(ms)
+	}
+
+	return &PairingCode{Code: code, ExpiresAt: expiresAt}, nil
+}
+
+// AttachWithCode attaches the desktop in the profile to the account that
+// created the pairing code. The code is redeemed over an anonymous session and
+// cannot be used again.
+func AttachWithCode(ctx context.Context, profileName, code, desktopName string) error {
+	code, err := ParsePairingCode(code)
+	if err != nil {
+		return err
+	}
+
+	profile, err := LoadProfile(profileName)
+	if err != nil {
+		return err
+	}
+
+	session, err := profile.connectAnonymous(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Leave() }()
+
+	return attachDesktop(profile, session, desktopName, map[string]any{"pairing_code": code})
+}
+
+// ParsePairingCode checks a pairing code as typed by a user, ignoring case,
+// spaces and dashes, and returns it in its XXXX-XXXX form.
+func ParsePairingCode(code string) (string, error) {
+	normalized := strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || r == ' ':
+			return -1
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return r
+		}
+	}, code)
+
+	if len(normalized) != pairingCodeLength {
+		return "", fmt.Errorf("invalid pairing code %q: expected XXXX-XXXX", code)
+	}
+	for _, r := range normalized {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return "", fmt.Errorf("invalid pairing code %q: expected letters and digits", code)
+		}
+	}
+
+	half := pairingCodeLength / 2
+	return normalized[:half] + "-" + normalized[half:], nil
+}
@@ -0,0 +1,127 @@
+package deskconn_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+	"github.com/xconnio/xconn-go"
+)
+
+// fakeCloud stands in for the cloud, handing out pairing codes and attaching
+// desktops that redeem them.
+type fakeCloud struct {
+	codes    map[string]bool
+	attached map[string]string
+	sync.Mutex
+}
+
+func (f *fakeCloud) createPairingCode(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	f.Lock()
+	defer f.Unlock()
+
+	code := fmt.Sprintf("K7QD-%04d", len(f.codes))
+	f.codes[code] = true
+	expiresAt := time.Now().Add(time.Duration(inv.KwargInt64Or("ttl_ms", 0)) * time.Millisecond)
+	result := xconn.NewInvocationResult(code)
+	result.Kwargs = map[string]any{"expires_at_ms": expiresAt.UnixMilli()}
+	return result
+}
+
+func (f *fakeCloud) attachDesktop(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	machineID, err := inv.ArgString(0)
+	if err != nil {
+		return xconn.NewInvocationError(deskconn.ErrInvalidArgument, err.Error())
+	}
+	publicKey, err := inv.ArgString(1)
+	if err != nil {
+		return xconn.NewInvocationError(deskconn.ErrInvalidArgument, err.Error())
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	code := inv.KwargStringOr("pairing_code", "")
+	if !f.codes[code] {
+		return xconn.NewInvocationError(deskconn.ErrNotAuthorized, "invalid pairing code")
+	}
+	delete(f.codes, code)
+	f.attached[machineID] = publicKey
+	return xconn.NewInvocationResult()
+}
+
+// setupFakeCloud serves a local router as the cloud of the staging profile and
+// returns a session of an account already logged in to it.
+func setupFakeCloud(t *testing.T) (*fakeCloud, *xconn.Session) {
+	setupConfigDir(t)
+
+	r, err := xconn.NewRouter(&xconn.RouterConfig{})
+	require.NoError(t, err)
+	// Anonymous sessions may only redeem pairing codes.
+	require.NoError(t, r.AddRealm(deskconn.Realm, &xconn.RealmConfig{
+		Roles: []xconn.RealmRole{
+			{Name: "anonymous", Permissions: []xconn.Permission{
+				{URI: deskconn.ProcedureDeskconnAttachDesktop, MatchPolicy: "exact", AllowCall: true},
+			}},
+		},
+	}))
+
+	server := xconn.NewServer(r, nil, &xconn.ServerConfig{})
+	listener, err := server.ListenAndServeWebSocket(xconn.NetworkTCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	require.NoError(t, deskconn.SaveProfile(&deskconn.Profile{
+		Name: "staging",
+		URI:  fmt.Sprintf("ws://%s/ws", listener.Addr()),
+	}))
+
+	cloud := &fakeCloud{codes: make(map[string]bool), attached: make(map[string]string)}
+	callee, err := xconn.ConnectInMemory(r, deskconn.Realm)
+	require.NoError(t, err)
+	require.NoError(t, callee.Register(deskconn.ProcedureDeskconnPairingCreate, cloud.createPairingCode).Do().Err)
+	require.NoError(t, callee.Register(deskconn.ProcedureDeskconnAttachDesktop, cloud.attachDesktop).Do().Err)
+
+	admin, err := xconn.ConnectInMemory(r, deskconn.Realm)
+	require.NoError(t, err)
+
+	return cloud, admin
+}
+
+func TestAttachWithCode(t *testing.T) {
+	cloud, admin := setupFakeCloud(t)
+
+	code, err := deskconn.CreatePairingCode(admin, 10*time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "K7QD-0000", code.Code)
+	require.WithinDuration(t, time.Now().Add(10*time.Minute), code.ExpiresAt, time.Minute)
+
+	// Codes are typed by people, so case and separators do not matter.
+	require.NoError(t, deskconn.AttachWithCode(context.Background(), "staging", "k7qd 0000", "laptop"))
+
+	profile, creds, err := deskconn.EnsureCredentials("staging")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{creds.AuthID: creds.PublicKey}, cloud.attached)
+	// Attaching keeps the cloud the profile points to.
+	require.Contains(t, profile.URI, "ws://127.0.0.1:")
+
+	// Other profiles are not attached along.
+	require.ErrorContains(t, deskconn.Detach(context.Background(), deskconn.DefaultProfile, deskconn.KeyOptions{}),
+		"desktop is not attached to profile default")
+
+	t.Run("Reused", func(t *testing.T) {
+		err := deskconn.AttachWithCode(context.Background(), "staging", code.Code, "laptop")
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, code := range []string{"", "K7QD-000", "K7QD-00000", "K7QD-00!0"} {
+			_, err := deskconn.ParsePairingCode(code)
+			require.Error(t, err, code)
+		}
+	})
+}
@@ -0,0 +1,287 @@
+package deskconn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/xconnio/xconn-go"
+)
+
+// DefaultProfile is the profile used when none is named.
+const DefaultProfile = "default"
+
+// Profile is a cloud the desktop can be attached to, stored as
+// profiles/<name>.json in the deskconn config directory. Each profile has its
+// own credentials, so a desktop can be attached to several clouds, such as
+// staging and production, at the same time.
+type Profile struct {
+	Name  string `json:"-"`
+	URI   string `json:"uri,omitempty"`
+	Realm string `json:"realm,omitempty"`
+	// Credentials are kept as written to disk, with the private key in their
+	// key storage. They are nil until the desktop is attached.
+	Credentials *Credentials `json:"credentials,omitempty"`
+}
+
+// ProfilesDir returns the directory profiles are stored in, under
+// $XDG_CONFIG_HOME or else ~/.config.
+func ProfilesDir() (string, error) {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		homedir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get user home dir: %w", err)
+		}
+		configDir = filepath.Join(homedir, ".config")
+	}
+
+	return filepath.Join(configDir, "deskconn", "profiles"), nil
+}
+
+// ProfilePath returns the path of the file of the named profile, creating the
+// profiles directory if needed.
+func ProfilePath(name string) (string, error) {
+	if err := validateProfileName(name); err != nil {
+		return "", err
+	}
+
+	dir, err := ProfilesDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create profiles dir: %w", err)
+	}
+
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// ListProfiles returns the names of the stored profiles, sorted.
+func ListProfiles() ([]string, error) {
+	dir, err := ProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read profiles dir: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() || validateProfileName(name) != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// LoadProfile reads the named profile. A profile that was never saved is
+// returned empty, ready to be configured or attached.
+func LoadProfile(name string) (*Profile, error) {
+	path, err := ProfilePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return loadLegacyProfile(name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read profile %s: %w", name, err)
+	}
+
+	profile := &Profile{Name: name}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal profile %s: %w", name, err)
+	}
+	return profile, nil
+}
+
+// SaveProfile writes a profile, replacing the stored one atomically.
+func SaveProfile(profile *Profile) error {
+	staged, err := stageProfile(profile)
+	if err != nil {
+		return err
+	}
+	return commitProfile(profile, staged)
+}
+
+// ConnectCRA logs in to the cloud of the profile as an account.
+func (p *Profile) ConnectCRA(ctx context.Context, username, password string) (*xconn.Session, error) {
+	uri, err := p.cloudURI()
+	if err != nil {
+		return nil, err
+	}
+	return xconn.ConnectCRA(ctx, uri, p.cloudRealm(), username, password)
+}
+
+// ConnectCryptosign logs in to the cloud of the profile as the desktop, with
+// its unlocked credentials.
+func (p *Profile) ConnectCryptosign(ctx context.Context, creds *Credentials) (*xconn.Session, error) {
+	uri, err := p.cloudURI()
+	if err != nil {
+		return nil, err
+	}
+	return xconn.ConnectCryptosign(ctx, uri, p.cloudRealm(), creds.AuthID, creds.PrivateKey)
+}
+
+func (p *Profile) connectAnonymous(ctx context.Context) (*xconn.Session, error) {
+	uri, err := p.cloudURI()
+	if err != nil {
+		return nil, err
+	}
+	return xconn.ConnectAnonymous(ctx, uri, p.cloudRealm())
+}
+
+// cloudURI returns the URI of the cloud router of the profile. Only the
+// default profile falls back to CloudURI, so that a misconfigured profile
+// never reaches the production cloud.
+func (p *Profile) cloudURI() (string, error) {
+	switch {
+	case p.URI != "":
+		return p.URI, nil
+	case p.Name == DefaultProfile:
+		return CloudURI(), nil
+	default:
+		return "", fmt.Errorf("profile %s has no cloud uri, set one with 'deskconnctl profile --profile %s --uri <uri>'",
+			p.Name, p.Name)
+	}
+}
+
+func (p *Profile) cloudRealm() string {
+	if p.Realm != "" {
+		return p.Realm
+	}
+	return Realm
+}
+
+// withCredentials returns a copy of the profile holding credentials, with
+// their private key moved to their key storage.
+func (p *Profile) withCredentials(creds *Credentials, passphrase string) (*Profile, error) {
+	profile := *p
+	if creds == nil {
+		profile.Credentials = nil
+		return &profile, nil
+	}
+
+	sealed, err := sealCredentials(*creds, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	profile.Credentials = &sealed
+	return &profile, nil
+}
+
+// stageProfile writes a profile to a temporary file next to its file, so that
+// it can replace it atomically.
+func stageProfile(profile *Profile) (string, error) {
+	path, err := ProfilePath(profile.Name)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal profile: %w", err)
+	}
+
+	// CreateTemp makes the file readable by the owner only.
+	file, err := os.CreateTemp(filepath.Dir(path), "."+profile.Name+"-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create profile file: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write profile file: %w", err)
+	}
+
+	return file.Name(), nil
+}
+
+func commitProfile(profile *Profile, staged string) error {
+	path, err := ProfilePath(profile.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(staged, path); err != nil {
+		_ = os.Remove(staged)
+		return fmt.Errorf("failed to replace profile file: %w", err)
+	}
+
+	// The credentials of older versions now live in the default profile.
+	if profile.Name == DefaultProfile {
+		if legacyPath, err := legacyCredentialsPath(); err == nil {
+			_ = os.Remove(legacyPath)
+		}
+	}
+	return nil
+}
+
+// loadLegacyProfile returns a profile that was never saved. The default
+// profile takes over the credentials file of older versions, if there is one,
+// until it is saved for the first time.
+func loadLegacyProfile(name string) (*Profile, error) {
+	profile := &Profile{Name: name}
+	if name != DefaultProfile {
+		return profile, nil
+	}
+
+	legacyPath, err := legacyCredentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(legacyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return profile, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal credentials: %w", err)
+	}
+	profile.Credentials = &creds
+	return profile, nil
+}
+
+func legacyCredentialsPath() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home dir: %w", err)
+	}
+	return filepath.Join(homedir, ".deskconn/credentials.env"), nil
+}
+
+func validateProfileName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && !strings.ContainsRune("._-", r) {
+			return fmt.Errorf("invalid profile name %q: expected letters, digits, '.', '_' or '-'", name)
+		}
+	}
+	return nil
+}
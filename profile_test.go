@@ -0,0 +1,93 @@
+package deskconn_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+)
+
+func TestProfiles(t *testing.T) {
+	dir := setupConfigDir(t)
+	require.Equal(t, filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "deskconn", "profiles"), dir)
+
+	names, err := deskconn.ListProfiles()
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	// A profile that was never saved is empty.
+	profile, err := deskconn.LoadProfile("staging")
+	require.NoError(t, err)
+	require.Equal(t, &deskconn.Profile{Name: "staging"}, profile)
+
+	profile.URI = "wss://staging.example.com/ws"
+	profile.Realm = "io.xconn.staging"
+	require.NoError(t, deskconn.SaveProfile(profile))
+	require.NoError(t, deskconn.SaveProfile(&deskconn.Profile{Name: "production"}))
+	// Left behind by an interrupted save.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".staging-1.tmp"), nil, 0600))
+
+	names, err = deskconn.ListProfiles()
+	require.NoError(t, err)
+	require.Equal(t, []string{"production", "staging"}, names)
+
+	loaded, err := deskconn.LoadProfile("staging")
+	require.NoError(t, err)
+	require.Equal(t, profile, loaded)
+
+	info, err := os.Stat(filepath.Join(dir, "staging.json"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	t.Run("HomeConfig", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		t.Setenv("XDG_CONFIG_HOME", "")
+
+		path, err := deskconn.ProfilePath("staging")
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(home, ".config", "deskconn", "profiles", "staging.json"), path)
+	})
+
+	t.Run("InvalidName", func(t *testing.T) {
+		for _, name := range []string{"", ".hidden", "../escape", "a/b", "with space"} {
+			_, err := deskconn.LoadProfile(name)
+			require.ErrorContains(t, err, "invalid profile name", name)
+		}
+	})
+
+	t.Run("NoURI", func(t *testing.T) {
+		// Only the default profile falls back to the built-in cloud.
+		err := deskconn.Attach(context.Background(), "production", "admin", "secret", "laptop")
+		require.ErrorContains(t, err, "deskconnctl profile --profile production --uri <uri>")
+	})
+}
+
+func TestLegacyCredentials(t *testing.T) {
+	setupConfigDir(t)
+	home := os.Getenv("HOME")
+	legacyPath := filepath.Join(home, ".deskconn/credentials.env")
+	require.NoError(t, os.MkdirAll(filepath.Dir(legacyPath), 0700))
+	data := `{"auth_id": "machine", "public_key": "public", "private_key": "private"}`
+	require.NoError(t, os.WriteFile(legacyPath, []byte(data), 0600))
+
+	// Credentials of older versions belong to the default profile only.
+	profile, err := deskconn.LoadProfile("staging")
+	require.NoError(t, err)
+	require.Nil(t, profile.Credentials)
+
+	profile, creds, err := deskconn.EnsureCredentials(deskconn.DefaultProfile)
+	require.NoError(t, err)
+	require.Equal(t, "private", creds.PrivateKey)
+	require.Empty(t, profile.URI)
+
+	// They are moved into the profile, which deskconnd then watches.
+	require.NoFileExists(t, legacyPath)
+	path, err := deskconn.ProfilePath(deskconn.DefaultProfile)
+	require.NoError(t, err)
+	require.Equal(t, "private", readStoredCredentials(t, path)["private_key"])
+}
@@ -0,0 +1,523 @@
+package deskconn
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	recordingExt       = ".cast"
+	recordingChunkSize = 64 * 1024
+	// recordingEventSize bounds the output in one event, so that a recording
+	// stopping at the size limit keeps the output up to close to it.
+	recordingEventSize = 1024
+
+	defaultRecordingCols = 80
+	defaultRecordingRows = 24
+)
+
+// ShellRecording controls the recording of shells as asciicast v2 files,
+// which terminal players such as asciinema replay with their original timing.
+type ShellRecording struct {
+	// Dir is where recordings are written; empty disables recording.
+	Dir string
+	// MaxAge removes recordings older than it when non-zero.
+	MaxAge time.Duration
+	// MaxFiles keeps at most this many recordings, counting the one being
+	// started, when non-zero.
+	MaxFiles int
+	// MaxBytes bounds the total size of the recordings when non-zero. The
+	// oldest recordings make room for the ones being written, and a recording
+	// that cannot fit stops where it reached the limit.
+	MaxBytes int64
+}
+
+// recordingHeader is the first line of an asciicast v2 file. The deskconn
+// fields are ignored by players and identify who started the shell.
+type recordingHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Shell     string            `json:"deskconn_shell,omitempty"`
+	AuthID    string            `json:"deskconn_authid,omitempty"`
+	Command   string            `json:"command,omitempty"`
+}
+
+// recorder writes the events of one shell to its recording. A nil recorder
+// records nothing.
+type recorder struct {
+	file    *os.File
+	started time.Time
+	// pending holds the start of a UTF-8 sequence split across two reads, as
+	// event data has to be valid text.
+	pending []byte
+	closed  bool
+
+	// written counts the bytes in the file, which may grow up to allowed
+	// before room is asked again how much the size limit leaves. room is nil
+	// without a size limit.
+	written int64
+	allowed int64
+	room    func(n int64) int64
+	// done is called once the file is closed.
+	done func()
+	sync.Mutex
+}
+
+func newRecorder(path string, header recordingHeader, room func(n int64) int64, done func()) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{file: file, started: time.Now(), room: room, done: done}
+	header.Version = 2
+	header.Timestamp = r.started.Unix()
+	line, err := json.Marshal(header)
+	if err == nil {
+		err = r.write(append(line, '\n'))
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// write must be called with the lock held.
+func (r *recorder) write(line []byte) error {
+	n, err := r.file.Write(line)
+	r.written += int64(n)
+	return err
+}
+
+// fits reports whether n more bytes keep the recordings within their size
+// limit. It must be called with the lock held.
+func (r *recorder) fits(n int64) bool {
+	if r.room == nil || r.written+n <= r.allowed {
+		return true
+	}
+
+	r.allowed = r.written + r.room(n)
+	return r.written+n <= r.allowed
+}
+
+// event must be called with the lock held.
+func (r *recorder) event(code, data string) {
+	if r.closed {
+		return
+	}
+
+	line, err := json.Marshal([]any{time.Since(r.started).Seconds(), code, data})
+	if err != nil {
+		log.Printf("Error encoding shell recording event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if !r.fits(int64(len(line))) {
+		log.Printf("Shell recording %s reached the size limit, recording stopped", r.file.Name())
+		r.pending = nil
+		r.closeFile()
+		return
+	}
+	if err := r.write(line); err != nil {
+		log.Printf("Error writing shell recording %s: %v", r.file.Name(), err)
+	}
+}
+
+func (r *recorder) output(chunk []byte) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	data := append(r.pending, chunk...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+
+	r.pending = append([]byte(nil), data[cut:]...)
+	for text := data[:cut]; len(text) > 0; {
+		end := min(len(text), recordingEventSize)
+		for end < len(text) && end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		if end == 0 {
+			end = min(len(text), recordingEventSize)
+		}
+		r.event("o", string(text[:end]))
+		text = text[end:]
+	}
+}
+
+func (r *recorder) resize(cols, rows uint16) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// mark records a marker, which players show as a point to jump to.
+func (r *recorder) mark(label string) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.event("m", label)
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+	r.closeFile()
+}
+
+// closeFile must be called with the lock held.
+func (r *recorder) closeFile() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if err := r.file.Close(); err != nil {
+		log.Printf("Error closing shell recording %s: %v", r.file.Name(), err)
+	}
+	if r.done != nil {
+		r.done()
+	}
+}
+
+func recordingName(started time.Time, id string) string {
+	return started.UTC().Format("20060102T150405Z") + "-" + id + recordingExt
+}
+
+type recordingFile struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+// listRecordings returns the recordings in a directory, least recently
+// written first.
+func listRecordings(dir string) ([]recordingFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]recordingFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != recordingExt {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, recordingFile{name: entry.Name(), size: info.Size(), modified: info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modified.Equal(files[j].modified) {
+			return files[i].modified.Before(files[j].modified)
+		}
+		return files[i].name < files[j].name
+	})
+	return files, nil
+}
+
+// pruneRecordings removes the oldest recordings beyond the retention limits,
+// leaving alone the ones still being written, and returns the total size of
+// the recordings left.
+func pruneRecordings(config ShellRecording, active map[string]bool) int64 {
+	files, err := listRecordings(config.Dir)
+	if err != nil {
+		log.Printf("Error listing shell recordings: %v", err)
+		return 0
+	}
+
+	var count int
+	var total int64
+	for _, file := range files {
+		count++
+		total += file.size
+	}
+
+	for _, file := range files {
+		expired := config.MaxAge > 0 && time.Since(file.modified) > config.MaxAge
+		tooMany := config.MaxFiles > 0 && count >= config.MaxFiles
+		tooLarge := config.MaxBytes > 0 && total > config.MaxBytes
+		if active[file.name] || !expired && !tooMany && !tooLarge {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(config.Dir, file.name)); err != nil {
+			log.Printf("Error removing shell recording %s: %v", file.name, err)
+			continue
+		}
+		count--
+		total -= file.size
+	}
+
+	return total
+}
+
+// activeRecordings holds the names of the recordings being written, which
+// pruning leaves alone. It has a lock of its own as recorders ask it for room
+// while their shell is locked.
+type activeRecordings struct {
+	names map[string]bool
+	sync.Mutex
+}
+
+func newActiveRecordings() *activeRecordings {
+	return &activeRecordings{names: make(map[string]bool)}
+}
+
+// start prunes the recordings for a new one and marks it as being written.
+func (a *activeRecordings) start(config ShellRecording, name string) {
+	a.Lock()
+	defer a.Unlock()
+
+	pruneRecordings(config, a.names)
+	a.names[name] = true
+}
+
+func (a *activeRecordings) finish(name string) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.names, name)
+}
+
+// room removes the oldest finished recordings until n more bytes fit within
+// the size limit, and returns how many bytes the recordings may grow by.
+func (a *activeRecordings) room(config ShellRecording, n int64) int64 {
+	if n >= config.MaxBytes {
+		return 0
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	total := pruneRecordings(ShellRecording{Dir: config.Dir, MaxBytes: config.MaxBytes - n}, a.names)
+	return config.MaxBytes - total
+}
+
+// readRecordingHeader returns the header of a recording, or nil if it cannot
+// be read.
+func readRecordingHeader(path string) *recordingHeader {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return nil
+	}
+
+	var header recordingHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil
+	}
+	return &header
+}
+
+// ownedBy reports whether the recording is of a shell started by the authid.
+// Recordings whose header cannot be read belong to no one.
+func (h *recordingHeader) ownedBy(authID string) bool {
+	return h != nil && h.AuthID == authID
+}
+
+func (p *interactiveShellSession) setRecording(recording ShellRecording) error {
+	if recording.Dir != "" {
+		if err := os.MkdirAll(recording.Dir, 0o700); err != nil {
+			return fmt.Errorf("failed to create shell recording directory: %w", err)
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.recording = recording
+	return nil
+}
+
+// startRecording must be called with the lock held.
+func (p *interactiveShellSession) startRecording(sh *shell, cols, rows uint16) (*recorder, error) {
+	if p.recording.Dir == "" {
+		return nil, nil
+	}
+
+	config := p.recording
+	name := recordingName(sh.started, sh.id)
+	p.recordings.start(config, name)
+
+	var room func(n int64) int64
+	if config.MaxBytes > 0 {
+		room = func(n int64) int64 { return p.recordings.room(config, n) }
+	}
+	r, err := newRecorder(filepath.Join(config.Dir, name), recordingHeader{
+		Width:   int(cols),
+		Height:  int(rows),
+		Title:   fmt.Sprintf("deskconn shell %s by %s", sh.id, sh.authID),
+		Env:     map[string]string{"TERM": defaultShellTerm},
+		Shell:   sh.id,
+		AuthID:  sh.authID,
+		Command: strings.Join(sh.cmd.Args, " "),
+	}, room, func() { p.recordings.finish(name) })
+	if err != nil {
+		p.recordings.finish(name)
+	}
+	return r, err
+}
+
+// recordingPath resolves a recording name from a caller, which must be one of
+// the files in the recording directory.
+func (p *interactiveShellSession) recordingPath(name string) (string, error) {
+	p.Lock()
+	dir := p.recording.Dir
+	p.Unlock()
+
+	if dir == "" {
+		return "", fmt.Errorf("shell recording is disabled")
+	}
+	if name != filepath.Base(name) || filepath.Ext(name) != recordingExt {
+		return "", fmt.Errorf("invalid recording name %q", name)
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// handleRecordingsList lists the recordings of the caller's own shells.
+func (p *interactiveShellSession) handleRecordingsList() func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		p.Lock()
+		dir := p.recording.Dir
+		p.Unlock()
+
+		if dir == "" {
+			return xconn.NewInvocationResult()
+		}
+
+		files, err := listRecordings(dir)
+		if err != nil {
+			return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+		}
+
+		result := make([]any, 0, len(files))
+		for _, file := range files {
+			header := readRecordingHeader(filepath.Join(dir, file.name))
+			if !header.ownedBy(inv.CallerAuthID()) {
+				continue
+			}
+			result = append(result, map[string]any{
+				"name":     file.name,
+				"size":     file.size,
+				"modified": file.modified.Unix(),
+				"shell":    header.Shell,
+				"authid":   header.AuthID,
+				"started":  header.Timestamp,
+			})
+		}
+
+		return xconn.NewInvocationResult(result...)
+	}
+}
+
+// handleRecordingsGet returns a recording of one of the caller's shells,
+// streamed in chunks to callers that take progressive results.
+func (p *interactiveShellSession) handleRecordingsGet() func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		name, err := inv.ArgString(0)
+		if err != nil {
+			return xconn.NewInvocationError(ErrInvalidArgument, "recording name is required")
+		}
+
+		path, err := p.recordingPath(name)
+		if err != nil {
+			return xconn.NewInvocationError(ErrInvalidArgument, err.Error())
+		}
+
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return xconn.NewInvocationError(ErrInvalidArgument, fmt.Sprintf("unknown recording %q", name))
+		} else if err != nil {
+			return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+		}
+		defer file.Close()
+
+		if !readRecordingHeader(path).ownedBy(inv.CallerAuthID()) {
+			return xconn.NewInvocationError(ErrNotAuthorized, fmt.Sprintf("recording %q belongs to another user", name))
+		}
+
+		if inv.SendProgress == nil {
+			data, err := io.ReadAll(file)
+			if err != nil {
+				return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+			}
+			return xconn.NewInvocationResult(data)
+		}
+
+		buf := make([]byte, recordingChunkSize)
+		for {
+			n, err := file.Read(buf)
+			if n > 0 {
+				if err := inv.SendProgress([]any{buf[:n]}, nil); err != nil {
+					return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+				}
+			}
+			if err == io.EOF {
+				return xconn.NewInvocationResult()
+			} else if err != nil {
+				return xconn.NewInvocationError(ErrOperationFailed, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package deskconn_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+	"github.com/xconnio/xconn-go"
+)
+
+// listRecordings maps the shell ids of the recordings to their names.
+func listRecordings(t *testing.T, session *xconn.Session) map[string]string {
+	response := session.Call(deskconn.ProcedureShellRecordingsList).Do()
+	require.NoError(t, response.Err)
+
+	recordings := make(map[string]string, len(response.Args()))
+	for i := range response.Args() {
+		info, err := response.ArgDict(i)
+		require.NoError(t, err)
+		name, err := info.String("name")
+		require.NoError(t, err)
+		shell, err := info.String("shell")
+		require.NoError(t, err)
+		recordings[shell] = name
+	}
+	return recordings
+}
+
+func killShell(t *testing.T, session *xconn.Session, sh *remoteShell) {
+	response := session.Call(deskconn.ProcedureShellKill).Kwarg("id", sh.id).Do()
+	require.NoError(t, response.Err)
+	sh.waitEnded(t)
+}
+
+func TestShellRecording(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	r := setupRouter(t)
+	callee, err := xconn.ConnectInMemory(r, "realm1")
+	require.NoError(t, err)
+	caller := connectAs(t, r, "alice")
+	intruder := connectAs(t, r, "mallory")
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(deskconn.ShellConfig{Command: "/bin/sh"})
+	require.NoError(t, d.SetShellRecording(deskconn.ShellRecording{Dir: t.TempDir(), MaxFiles: 2}))
+	require.NoError(t, d.RegisterLocal(callee))
+
+	resize := xconn.NewProgress()
+	resize.Kwargs = map[string]any{"frame": "resize", "version": 1, "cols": 100, "rows": 40}
+	sh := openShell(t, caller, deskconn.ProcedureShell, resize)
+	sh.send("echo recorded-$((5*5))\n")
+	sh.waitFor(t, "recorded-25")
+	// Messages may be handled out of order, so give the resize time to land.
+	sh.sendFrame("resize", map[string]any{"cols": 120, "rows": 50})
+	sh.send("sleep 0.2; stty size\n")
+	sh.waitFor(t, "50 120")
+	killShell(t, caller, sh)
+
+	name := listRecordings(t, caller)[sh.id]
+	require.NotEmpty(t, name)
+
+	response := caller.Call(deskconn.ProcedureShellRecordingsGet).Arg(name).Do()
+	require.NoError(t, response.Err)
+	recording, err := response.ArgBytes(0)
+	require.NoError(t, err)
+
+	t.Run("Format", func(t *testing.T) {
+		scanner := bufio.NewScanner(bytes.NewReader(recording))
+		require.True(t, scanner.Scan())
+		var header map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &header))
+		require.Equal(t, float64(2), header["version"])
+		require.Equal(t, float64(100), header["width"])
+		require.Equal(t, float64(40), header["height"])
+		require.Equal(t, sh.id, header["deskconn_shell"])
+
+		var output bytes.Buffer
+		events := map[string][]string{}
+		last := 0.0
+		for scanner.Scan() {
+			var event []any
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			require.Len(t, event, 3)
+			elapsed, code, data := event[0].(float64), event[1].(string), event[2].(string)
+			require.GreaterOrEqual(t, elapsed, last)
+			last = elapsed
+			events[code] = append(events[code], data)
+			if code == "o" {
+				output.WriteString(data)
+			}
+		}
+		require.Contains(t, output.String(), "recorded-25")
+		require.Equal(t, []string{"120x50"}, events["r"])
+		require.NotEmpty(t, events["m"])
+		require.Contains(t, events["m"][0], "attached by")
+	})
+
+	t.Run("Progressive", func(t *testing.T) {
+		var streamed bytes.Buffer
+		response := caller.Call(deskconn.ProcedureShellRecordingsGet).Arg(name).
+			ProgressReceiver(func(result *xconn.ProgressResult) {
+				streamed.Write(result.ArgBytesOr(0, nil))
+			}).Do()
+		require.NoError(t, response.Err)
+		require.Equal(t, recording, streamed.Bytes())
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		require.Empty(t, listRecordings(t, intruder))
+
+		response := intruder.Call(deskconn.ProcedureShellRecordingsGet).Arg(name).Do()
+		require.ErrorContains(t, response.Err, deskconn.ErrNotAuthorized)
+	})
+
+	t.Run("InvalidName", func(t *testing.T) {
+		response := caller.Call(deskconn.ProcedureShellRecordingsGet).Arg("../" + name).Do()
+		require.ErrorContains(t, response.Err, deskconn.ErrInvalidArgument)
+
+		response = caller.Call(deskconn.ProcedureShellRecordingsGet).Arg("missing.cast").Do()
+		require.ErrorContains(t, response.Err, deskconn.ErrInvalidArgument)
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		second := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+		third := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+
+		recordings := listRecordings(t, caller)
+		require.Len(t, recordings, 2)
+		require.NotContains(t, recordings, sh.id)
+		require.Contains(t, recordings, second.id)
+		require.Contains(t, recordings, third.id)
+	})
+}
+
+func TestShellRecordingSizeLimit(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	r := setupRouter(t)
+	callee, err := xconn.ConnectInMemory(r, "realm1")
+	require.NoError(t, err)
+	caller := connectAs(t, r, "alice")
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(quietShell)
+	dir := t.TempDir()
+	const limit = 8 * 1024
+	require.NoError(t, d.SetShellRecording(deskconn.ShellRecording{Dir: dir, MaxBytes: limit}))
+	require.NoError(t, d.RegisterLocal(callee))
+
+	first := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+	first.send("echo first-$((2*3))\n")
+	first.waitFor(t, "first-6")
+	killShell(t, caller, first)
+	require.Contains(t, listRecordings(t, caller), first.id)
+
+	// A single shell writing well past the limit is recorded only up to it,
+	// pushing out the older recording on the way.
+	second := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+	second.send("yes recorded | head -c 65536; echo; echo second-$((3*3))\n")
+	second.waitFor(t, "second-9")
+
+	recordings := listRecordings(t, caller)
+	require.NotContains(t, recordings, first.id)
+	require.Contains(t, recordings, second.id)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		require.NoError(t, err)
+		total += info.Size()
+	}
+	require.LessOrEqual(t, total, int64(limit))
+	require.Greater(t, total, int64(limit/2))
+
+	killShell(t, caller, second)
+}
@@ -1,17 +1,27 @@
 package deskconn
 
 import (
+	"errors"
 	"fmt"
 	"math"
-	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
 )
 
-var BacklightBasePath = "/sys/class/backlight" //nolint: gochecknoglobals
+const (
+	logindService      = "org.freedesktop.login1"
+	logindManagerPath  = "/org/freedesktop/login1"
+	logindManagerIface = "org.freedesktop.login1.Manager"
+	logindSessionIface = "org.freedesktop.login1.Session"
+	logindAutoSession  = "/org/freedesktop/login1/session/auto"
+
+	dbusPropertiesChanged = "org.freedesktop.DBus.Properties.PropertiesChanged"
+)
 
 type lockProvider struct {
 	service string
@@ -19,18 +29,27 @@ type lockProvider struct {
 	iface   string
 	lock    string
 	active  string
+	changed string
+	setter  string
 }
 
 func lockProviders() []*lockProvider {
 	return []*lockProvider{
-		{"org.gnome.ScreenSaver", "/org/gnome/ScreenSaver", "org.gnome.ScreenSaver", "Lock", "GetActive"},
-		{"org.freedesktop.ScreenSaver", "/ScreenSaver", "org.freedesktop.ScreenSaver", "Lock", "GetActive"},
-		{"com.canonical.Unity.Session", "/com/canonical/Unity/Session", "com.canonical.Unity.Session", "Lock", "IsLocked"},
-		{"org.cinnamon.ScreenSaver", "/org/cinnamon/ScreenSaver", "org.cinnamon.ScreenSaver", "Lock", "GetActive"},
-		{"org.mate.ScreenSaver", "/org/mate/ScreenSaver", "org.mate.ScreenSaver", "Lock", "GetActive"},
-		{"org.xscreensaver", "/org/xscreensaver/ScreenSaver", "org.xscreensaver.ScreenSaver", "Lock", "GetActive"},
-		{"org.lxqt.ScreenSaver", "/org/lxqt/ScreenSaver", "org.lxqt.ScreenSaver", "Lock", "GetActive"},
-		{"org.xfce.SessionManager", "/org/xfce/SessionManager", "org.xfce.SessionManager", "Lock", ""},
+		{"org.gnome.ScreenSaver", "/org/gnome/ScreenSaver", "org.gnome.ScreenSaver", "Lock", "GetActive",
+			"ActiveChanged", "SetActive"},
+		{"org.freedesktop.ScreenSaver", "/ScreenSaver", "org.freedesktop.ScreenSaver", "Lock", "GetActive",
+			"ActiveChanged", "SetActive"},
+		{"com.canonical.Unity.Session", "/com/canonical/Unity/Session", "com.canonical.Unity.Session", "Lock",
+			"IsLocked", "", ""},
+		{"org.cinnamon.ScreenSaver", "/org/cinnamon/ScreenSaver", "org.cinnamon.ScreenSaver", "Lock", "GetActive",
+			"ActiveChanged", "SetActive"},
+		{"org.mate.ScreenSaver", "/org/mate/ScreenSaver", "org.mate.ScreenSaver", "Lock", "GetActive",
+			"ActiveChanged", "SetActive"},
+		{"org.xscreensaver", "/org/xscreensaver/ScreenSaver", "org.xscreensaver.ScreenSaver", "Lock", "GetActive",
+			"", ""},
+		{"org.lxqt.ScreenSaver", "/org/lxqt/ScreenSaver", "org.lxqt.ScreenSaver", "Lock", "GetActive",
+			"ActiveChanged", ""},
+		{"org.xfce.SessionManager", "/org/xfce/SessionManager", "org.xfce.SessionManager", "Lock", "", "", ""},
 	}
 }
 
@@ -40,11 +59,22 @@ type Screen struct {
 
 	lockProvider    *lockProvider
 	lockInitialized bool
+	logindSession   dbus.ObjectPath
+
+	locked       *bool
+	lockHandlers []func(locked bool)
+	mu           sync.Mutex
+
+	kbdUPower bool
+	kbdLed    *backlight
 
-	brightnessFilePath     string
-	maxBrightness          int
-	brightnessDeviceName   string
-	brightnessDeviceExists bool
+	displayPowerCommand []string
+	displayOff          bool
+
+	backlights         []*backlight
+	brightnessBackend  BrightnessBackend
+	brightnessWatcher  *fsnotify.Watcher
+	brightnessHandlers []func(device string, percent int)
 }
 
 func NewScreen(sessionBus, systemBus *dbus.Conn) *Screen {
@@ -53,88 +83,195 @@ func NewScreen(sessionBus, systemBus *dbus.Conn) *Screen {
 		systemBus:  systemBus,
 	}
 
-	for _, p := range lockProviders() {
-		obj := sessionBus.Object(p.service, p.path)
-		call := obj.Call("org.freedesktop.DBus.Introspectable.Introspect", 0)
-		if call.Err != nil &&
-			strings.Contains(call.Err.Error(), "org.freedesktop.DBus.Error.ServiceUnknown") {
-			continue
-		}
+	s.lockProvider, s.lockInitialized = findLockProvider(sessionBus)
+	s.watchLock()
 
-		s.lockProvider = p
-		s.lockInitialized = call.Err == nil
-		break
+	s.detectKeyboardBacklight()
+
+	s.backlights = findBacklights(BacklightBasePath)
+	s.brightnessBackend = s.detectBrightnessBackend()
+	if len(s.backlights) > 0 {
+		if err := s.watchBrightness(); err != nil {
+			log.Printf("failed to watch backlight brightness: %v", err)
+		}
 	}
 
-	entries, err := os.ReadDir(BacklightBasePath)
-	if err != nil {
-		return s
+	return s
+}
+
+// Close stops watching for screen changes.
+func (s *Screen) Close() error {
+	if s.brightnessWatcher != nil {
+		return s.brightnessWatcher.Close()
 	}
 
-	for _, e := range entries {
-		full := filepath.Join(BacklightBasePath, e.Name())
-		info, err := os.Stat(full)
-		if err != nil || !info.IsDir() {
-			continue
-		}
+	return nil
+}
 
-		raw, err := os.ReadFile(filepath.Join(full, "max_brightness"))
-		if err != nil {
+func findLockProvider(sessionBus *dbus.Conn) (*lockProvider, bool) {
+	for _, p := range lockProviders() {
+		obj := sessionBus.Object(p.service, p.path)
+		call := obj.Call("org.freedesktop.DBus.Introspectable.Introspect", 0)
+		if isServiceUnknown(call.Err) {
 			continue
 		}
 
-		max, _ := strconv.Atoi(strings.TrimSpace(string(raw)))
-
-		s.brightnessDeviceName = e.Name()
-		s.brightnessFilePath = filepath.Join(full, "brightness")
-		s.maxBrightness = max
-		s.brightnessDeviceExists = true
-		break
+		return p, call.Err == nil
 	}
 
-	return s
+	return nil, false
+}
+
+// activeLockProvider returns the detected provider, or nil when none is usable.
+func (s *Screen) activeLockProvider() *lockProvider {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.lockInitialized {
+		return nil
+	}
+	return s.lockProvider
 }
 
 func (s *Screen) Lock() error {
-	if !s.lockInitialized || s.lockProvider == nil {
+	provider := s.activeLockProvider()
+	if provider == nil {
 		return fmt.Errorf("screen lock provider not initialized")
 	}
 
-	obj := s.sessionBus.Object(s.lockProvider.service, s.lockProvider.path)
-	return obj.Call(s.lockProvider.iface+"."+s.lockProvider.lock, 0).Err
+	obj := s.sessionBus.Object(provider.service, provider.path)
+	return obj.Call(provider.iface+"."+provider.lock, 0).Err
 }
 
 func (s *Screen) IsLocked() (bool, error) {
-	if !s.lockInitialized || s.lockProvider == nil {
+	provider := s.activeLockProvider()
+	if provider == nil {
 		return false, fmt.Errorf("screen lock provider not initialized")
 	}
-	if s.lockProvider.active == "" {
+	if provider.active == "" {
 		return false, fmt.Errorf("provider does not support isLocked")
 	}
 
-	obj := s.sessionBus.Object(s.lockProvider.service, s.lockProvider.path)
+	obj := s.sessionBus.Object(provider.service, provider.path)
 	var active bool
-	err := obj.Call(s.lockProvider.iface+"."+s.lockProvider.active, 0).Store(&active)
+	err := obj.Call(provider.iface+"."+provider.active, 0).Store(&active)
 	return active, err
 }
 
+// Unlock asks logind to unlock the session, which every logind aware locker
+// obeys, and falls back to deactivating the lock provider directly.
+func (s *Screen) Unlock() error {
+	if s.systemBus != nil {
+		obj := s.systemBus.Object(logindService, logindAutoSession)
+		if err := obj.Call(logindSessionIface+".Unlock", 0).Err; err == nil {
+			// only the session owner may set the hint, so failing here is fine
+			_ = obj.Call(logindSessionIface+".SetLockedHint", 0, false).Err
+			return nil
+		}
+	}
+
+	provider := s.activeLockProvider()
+	if provider == nil || provider.setter == "" {
+		return fmt.Errorf("screen unlock not supported")
+	}
+
+	obj := s.sessionBus.Object(provider.service, provider.path)
+	return obj.Call(provider.iface+"."+provider.setter, 0, false).Err
+}
+
+// LockInfo describes what the detected lock provider is capable of.
+type LockInfo struct {
+	Service           string
+	IsLockedSupported bool
+	UnlockSupported   bool
+}
+
+func (s *Screen) LockInfo() LockInfo {
+	info := LockInfo{UnlockSupported: logindAvailable(s.systemBus)}
+	provider := s.activeLockProvider()
+	if provider == nil {
+		return info
+	}
+
+	info.Service = provider.service
+	info.IsLockedSupported = provider.active != ""
+	info.UnlockSupported = info.UnlockSupported || provider.setter != ""
+	return info
+}
+
+// Backlights lists every backlight device, most preferred first.
+func (s *Screen) Backlights() []BacklightDevice {
+	devices := make([]BacklightDevice, 0, len(s.backlights))
+	for i, b := range s.backlights {
+		current, _ := b.current()
+		devices = append(devices, BacklightDevice{
+			Name:          b.name,
+			Type:          b.typ,
+			MaxBrightness: b.max,
+			Brightness:    current,
+			Default:       i == 0,
+		})
+	}
+
+	return devices
+}
+
+// backlight returns the named device, or the preferred one when name is empty.
+func (s *Screen) backlight(name string) (*backlight, error) {
+	if len(s.backlights) == 0 {
+		return nil, fmt.Errorf("brightness device not available")
+	}
+
+	if name == "" {
+		return s.backlights[0], nil
+	}
+
+	for _, b := range s.backlights {
+		if b.name == name {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", errBacklightNotFound, name)
+}
+
 func (s *Screen) GetBrightness() (int, error) {
-	if !s.brightnessDeviceExists {
-		return 0, fmt.Errorf("brightness device not available")
+	return s.GetDeviceBrightness("")
+}
+
+func (s *Screen) SetBrightness(percent int) error {
+	return s.SetDeviceBrightness("", percent)
+}
+
+// GetDeviceBrightness returns the brightness percentage of the named
+// backlight, or of the preferred backlight when device is empty.
+func (s *Screen) GetDeviceBrightness(device string) (int, error) {
+	b, err := s.backlight(device)
+	if err != nil {
+		return 0, err
 	}
 
-	raw, err := os.ReadFile(s.brightnessFilePath)
+	current, err := b.current()
 	if err != nil {
 		return 0, err
 	}
 
-	current, _ := strconv.Atoi(strings.TrimSpace(string(raw)))
-	return (current * 100) / s.maxBrightness, nil
+	return b.toPercent(current), nil
 }
 
-func (s *Screen) SetBrightness(percent int) error {
-	if !s.brightnessDeviceExists {
-		return fmt.Errorf("brightness device not available")
+// SetDeviceBrightness sets the brightness percentage of the named backlight,
+// or of the preferred backlight when device is empty.
+func (s *Screen) SetDeviceBrightness(device string, percent int) error {
+	return s.FadeDeviceBrightness(device, percent, 0)
+}
+
+// FadeDeviceBrightness moves the backlight to percent in small steps spread
+// over duration. A running fade is abandoned as soon as another brightness
+// change for the same device arrives, in which case it returns nil.
+func (s *Screen) FadeDeviceBrightness(device string, percent int, duration time.Duration) error {
+	b, err := s.backlight(device)
+	if err != nil {
+		return err
 	}
 
 	if percent < 1 {
@@ -144,13 +281,390 @@ func (s *Screen) SetBrightness(percent int) error {
 		percent = 100
 	}
 
-	value := (percent * s.maxBrightness) / 100
-	if value < 0 || value > math.MaxUint32 {
-		return fmt.Errorf("brightness value out of uint32 range: %d", value)
+	target := (percent * b.max) / 100
+	if target < 0 || target > math.MaxUint32 {
+		return fmt.Errorf("brightness value out of uint32 range: %d", target)
+	}
+
+	b.mu.Lock()
+	b.fade++
+	fade := b.fade
+	b.mu.Unlock()
+
+	// step writes one value unless a newer change took over the device
+	step := func(value int) (bool, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.fade != fade {
+			return false, nil
+		}
+		return true, s.writeBrightness(b, value)
+	}
+
+	steps := int(duration / fadeInterval)
+	start, err := b.current()
+	if steps <= 1 || err != nil {
+		_, err := step(target)
+		return err
+	}
+
+	ticker := time.NewTicker(fadeInterval)
+	defer ticker.Stop()
+
+	for i := 1; i <= steps; i++ {
+		ok, err := step(start + ((target-start)*i)/steps)
+		if !ok || err != nil {
+			return err
+		}
+
+		if i < steps {
+			<-ticker.C
+		}
+	}
+
+	return nil
+}
+
+func (s *Screen) writeBrightness(b *backlight, value int) error {
+	s.mu.Lock()
+	backend := s.brightnessBackend
+	s.mu.Unlock()
+
+	return backend.SetBrightness(b.name, value)
+}
+
+// detectBrightnessBackend keeps logind as the default and only falls back to
+// writing sysfs directly when logind is missing and the file is writable.
+func (s *Screen) detectBrightnessBackend() BrightnessBackend {
+	if len(s.backlights) > 0 && !logindAvailable(s.systemBus) && sysfsWritable(BacklightBasePath, s.backlights[0].name) {
+		return NewSysfsBrightnessBackend(BacklightBasePath)
 	}
 
-	obj := s.systemBus.Object("org.freedesktop.login1", "/org/freedesktop/login1/session/auto")
+	return NewLogindBrightnessBackend(s.systemBus)
+}
+
+// SetBrightnessBackend overrides the automatically detected brightness backend.
+func (s *Screen) SetBrightnessBackend(backend BrightnessBackend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.brightnessBackend = backend
+}
+
+// BrightnessInfo describes how brightness changes are applied.
+type BrightnessInfo struct {
+	Backend string
+	Device  string
+}
+
+func (s *Screen) BrightnessInfo() (BrightnessInfo, error) {
+	b, err := s.backlight("")
+	if err != nil {
+		return BrightnessInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return BrightnessInfo{Backend: s.brightnessBackend.Name(), Device: b.name}, nil
+}
+
+// OnLockChanged registers a handler that is called whenever the screen
+// transitions between locked and unlocked.
+func (s *Screen) OnLockChanged(handler func(locked bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lockHandlers = append(s.lockHandlers, handler)
+}
+
+// OnBrightnessChanged registers a handler that is called with the device name
+// and new percentage whenever a backlight changes brightness, including
+// changes made outside deskconn such as brightness keys.
+func (s *Screen) OnBrightnessChanged(handler func(device string, percent int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.brightnessHandlers = append(s.brightnessHandlers, handler)
+}
+
+func (s *Screen) watchLock() {
+	s.watchLockProvider(s.activeLockProvider(), true)
+
+	// desktop shells often start after deskconnd, so follow the providers
+	// claiming or releasing their names and detect again when they do
+	for _, p := range lockProviders() {
+		err := s.sessionBus.AddMatchSignal(
+			dbus.WithMatchSender("org.freedesktop.DBus"),
+			dbus.WithMatchInterface("org.freedesktop.DBus"),
+			dbus.WithMatchMember("NameOwnerChanged"),
+			dbus.WithMatchArg(0, p.service),
+		)
+		if err != nil {
+			log.Printf("failed to watch %s for name changes: %v", p.service, err)
+		}
+	}
+
+	sessionPath, err := resolveLogindSession(s.systemBus)
+	if err == nil {
+		err = s.systemBus.AddMatchSignal(
+			dbus.WithMatchObjectPath(sessionPath),
+			dbus.WithMatchInterface(logindSessionIface),
+		)
+	}
+	if err == nil {
+		err = s.systemBus.AddMatchSignal(
+			dbus.WithMatchObjectPath(sessionPath),
+			dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+			dbus.WithMatchMember("PropertiesChanged"),
+			dbus.WithMatchArg(0, logindSessionIface),
+		)
+	}
+	if err != nil {
+		log.Printf("failed to watch logind session for lock changes: %v", err)
+	} else {
+		s.logindSession = sessionPath
+	}
+
+	sessionSignals := make(chan *dbus.Signal, 16)
+	s.sessionBus.Signal(sessionSignals)
+	go s.dispatchSignals(sessionSignals)
+
+	if s.systemBus != s.sessionBus {
+		systemSignals := make(chan *dbus.Signal, 16)
+		s.systemBus.Signal(systemSignals)
+		go s.dispatchSignals(systemSignals)
+	}
+}
+
+// watchLockProvider adds or removes the match rule for the lock state signal
+// of provider.
+func (s *Screen) watchLockProvider(provider *lockProvider, watch bool) {
+	if provider == nil || provider.changed == "" {
+		return
+	}
+
+	options := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(provider.path),
+		dbus.WithMatchInterface(provider.iface),
+		dbus.WithMatchMember(provider.changed),
+	}
+
+	var err error
+	if watch {
+		err = s.sessionBus.AddMatchSignal(options...)
+	} else {
+		err = s.sessionBus.RemoveMatchSignal(options...)
+	}
+	if err != nil {
+		log.Printf("failed to update lock change watch for %s: %v", provider.service, err)
+	}
+}
+
+func (s *Screen) redetectLockProvider() {
+	provider, initialized := findLockProvider(s.sessionBus)
+
+	s.mu.Lock()
+	previous := s.lockProvider
+	if !s.lockInitialized {
+		previous = nil
+	}
+	s.lockProvider, s.lockInitialized = provider, initialized
+	s.mu.Unlock()
+
+	if !initialized {
+		provider = nil
+	}
+	if lockProviderName(previous) == lockProviderName(provider) {
+		return
+	}
+
+	s.watchLockProvider(previous, false)
+	s.watchLockProvider(provider, true)
+	log.Printf("screen lock provider changed from %s to %s", lockProviderName(previous),
+		lockProviderName(provider))
+}
+
+func isLockProviderService(name any) bool {
+	for _, p := range lockProviders() {
+		if p.service == name {
+			return true
+		}
+	}
+	return false
+}
+
+func lockProviderName(provider *lockProvider) string {
+	if provider == nil {
+		return "none"
+	}
+	return provider.service
+}
+
+func (s *Screen) dispatchSignals(signals <-chan *dbus.Signal) {
+	for sig := range signals {
+		provider := s.activeLockProvider()
+
+		switch {
+		case sig.Name == "org.freedesktop.DBus.NameOwnerChanged" && len(sig.Body) > 0 &&
+			isLockProviderService(sig.Body[0]):
+			s.redetectLockProvider()
+		case provider != nil && provider.changed != "" && sig.Path == provider.path &&
+			sig.Name == provider.iface+"."+provider.changed:
+			if len(sig.Body) == 0 {
+				continue
+			}
+			if active, ok := sig.Body[0].(bool); ok {
+				s.setLocked(active)
+			}
+		case s.logindSession != "" && sig.Path == s.logindSession && sig.Name == dbusPropertiesChanged:
+			s.lockedHintChanged(sig)
+		case s.logindSession != "" && sig.Path == s.logindSession &&
+			(sig.Name == logindSessionIface+".Lock" || sig.Name == logindSessionIface+".Unlock"):
+			// logind only asks the locker to lock or unlock, which it may
+			// refuse or do later, so look at the state instead
+			s.refreshLocked()
+		}
+	}
+}
+
+// lockedHintChanged follows the LockedHint of the logind session, which
+// lockers set once the screen actually is locked or unlocked.
+func (s *Screen) lockedHintChanged(sig *dbus.Signal) {
+	if len(sig.Body) < 2 || sig.Body[0] != logindSessionIface {
+		return
+	}
+
+	changed, _ := sig.Body[1].(map[string]dbus.Variant)
+	if hint, ok := changed["LockedHint"]; ok {
+		if locked, ok := hint.Value().(bool); ok {
+			s.setLocked(locked)
+		}
+	}
+}
+
+// refreshLocked reads the lock state from the lock provider, or from the
+// LockedHint of the logind session when the provider cannot tell.
+func (s *Screen) refreshLocked() {
+	locked, err := s.IsLocked()
+	if err != nil {
+		locked, err = s.lockedHint()
+	}
+	if err != nil {
+		log.Printf("failed to read screen lock state: %v", err)
+		return
+	}
+
+	s.setLocked(locked)
+}
+
+func (s *Screen) lockedHint() (bool, error) {
+	obj := s.systemBus.Object(logindService, s.logindSession)
+	hint, err := obj.GetProperty(logindSessionIface + ".LockedHint")
+	if err != nil {
+		return false, err
+	}
+
+	locked, ok := hint.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected LockedHint value %v", hint.Value())
+	}
+	return locked, nil
+}
+
+func (s *Screen) setLocked(locked bool) {
+	s.mu.Lock()
+	if s.locked != nil && *s.locked == locked {
+		s.mu.Unlock()
+		return
+	}
+	s.locked = &locked
+	handlers := append([]func(bool){}, s.lockHandlers...)
+	s.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(locked)
+	}
+}
+
+func isServiceUnknown(err error) bool {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) {
+		return dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown"
+	}
+
+	return err != nil && strings.Contains(err.Error(), "org.freedesktop.DBus.Error.ServiceUnknown")
+}
+
+func (s *Screen) watchBrightness() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	watched := make(map[string]*backlight, len(s.backlights))
+	for _, b := range s.backlights {
+		if err := watcher.Add(b.dir); err != nil {
+			_ = watcher.Close()
+			return fmt.Errorf("failed to add watcher: %w", err)
+		}
+
+		current, _ := b.current()
+		b.percent = b.toPercent(current)
+		watched[b.actualBrightnessPath()] = b
+	}
+
+	s.brightnessWatcher = watcher
+
+	go func() {
+		for event := range watcher.Events {
+			b, ok := watched[event.Name]
+			if !ok || event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+
+			if b.debounce != nil {
+				b.debounce.Stop()
+			}
+			b.debounce = time.AfterFunc(brightnessDebounce, func() { s.brightnessChanged(b) })
+		}
+	}()
+
+	return nil
+}
+
+func (s *Screen) brightnessChanged(b *backlight) {
+	current, err := readSysfsInt(b.actualBrightnessPath())
+	if err != nil {
+		return
+	}
+	percent := b.toPercent(current)
+
+	s.mu.Lock()
+	if percent == b.percent {
+		s.mu.Unlock()
+		return
+	}
+	b.percent = percent
+	handlers := append([]func(string, int){}, s.brightnessHandlers...)
+	s.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(b.name, percent)
+	}
+}
+
+// resolveLogindSession returns the object path of the session logind picks
+// for "auto", since signals are emitted on the real session path only.
+func resolveLogindSession(systemBus *dbus.Conn) (dbus.ObjectPath, error) {
+	id, err := systemBus.Object(logindService, logindAutoSession).GetProperty(logindSessionIface + ".Id")
+	if err != nil {
+		return "", err
+	}
 
-	return obj.Call("org.freedesktop.login1.Session.SetBrightness", 0, "backlight", s.brightnessDeviceName,
-		uint32(value)).Err
+	var path dbus.ObjectPath
+	err = systemBus.Object(logindService, logindManagerPath).
+		Call(logindManagerIface+".GetSession", 0, id).Store(&path)
+	return path, err
 }
@@ -1,11 +1,21 @@
 package deskconn_test
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
 	"github.com/stretchr/testify/require"
 
 	"github.com/xconnio/deskconn"
@@ -18,6 +28,14 @@ func TestLock(t *testing.T) {
 	require.EqualError(t, err, "screen lock provider not initialized")
 }
 
+func TestUnlock(t *testing.T) {
+	ls := &deskconn.Screen{}
+
+	err := ls.Unlock()
+	require.EqualError(t, err, "screen unlock not supported")
+	require.Equal(t, deskconn.LockInfo{}, ls.LockInfo())
+}
+
 func TestIsLocked(t *testing.T) {
 	ls := &deskconn.Screen{}
 
@@ -111,3 +129,469 @@ func TestGetBrightnessFileError(t *testing.T) {
 	_, err = b.GetBrightness()
 	require.Error(t, err)
 }
+
+const privateBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>`
+
+// startPrivateBus runs a throwaway dbus-daemon and returns its address.
+func startPrivateBus(t testing.TB) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(privateBusConfig, dir)), 0600)
+	require.NoError(t, err)
+
+	cmd := exec.Command("dbus-daemon", "--config-file="+config, "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+
+	return strings.TrimSpace(address)
+}
+
+func connectPrivateBus(t testing.TB, address string) *dbus.Conn {
+	t.Helper()
+
+	conn, err := dbus.Connect(address)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+type fakeScreenSaver struct {
+	active atomic.Bool
+}
+
+func (f *fakeScreenSaver) Lock() *dbus.Error {
+	f.active.Store(true)
+	return nil
+}
+
+func (f *fakeScreenSaver) GetActive() (bool, *dbus.Error) {
+	return f.active.Load(), nil
+}
+
+func (f *fakeScreenSaver) SetActive(active bool) *dbus.Error {
+	f.active.Store(active)
+	return nil
+}
+
+// exportFakeScreenSaver claims org.freedesktop.ScreenSaver on the given bus.
+func exportFakeScreenSaver(t *testing.T, conn *dbus.Conn) *fakeScreenSaver {
+	t.Helper()
+
+	const (
+		service = "org.freedesktop.ScreenSaver"
+		path    = dbus.ObjectPath("/ScreenSaver")
+	)
+
+	fake := &fakeScreenSaver{}
+	require.NoError(t, conn.Export(fake, path, service))
+	node := &introspect.Node{
+		Name: string(path),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{Name: service, Methods: introspect.Methods(fake)},
+		},
+	}
+	require.NoError(t, conn.Export(introspect.NewIntrospectable(node), path, "org.freedesktop.DBus.Introspectable"))
+
+	reply, err := conn.RequestName(service, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+
+	return fake
+}
+
+func TestLockChanged(t *testing.T) {
+	address := startPrivateBus(t)
+	providerConn := connectPrivateBus(t, address)
+	exportFakeScreenSaver(t, providerConn)
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	changes := make(chan bool, 4)
+	s.OnLockChanged(func(locked bool) { changes <- locked })
+
+	require.NoError(t, s.Lock())
+	locked, err := s.IsLocked()
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	emit := func(active bool) {
+		err := providerConn.Emit("/ScreenSaver", "org.freedesktop.ScreenSaver.ActiveChanged", active)
+		require.NoError(t, err)
+	}
+
+	emit(true)
+	// repeated states are not reported again
+	emit(true)
+	emit(false)
+
+	for _, expected := range []bool{true, false} {
+		select {
+		case got := <-changes:
+			require.Equal(t, expected, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("lock change not received")
+		}
+	}
+
+	select {
+	case got := <-changes:
+		t.Fatalf("unexpected lock change %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type fakeLogindManager struct {
+	session dbus.ObjectPath
+}
+
+func (f *fakeLogindManager) GetSession(string) (dbus.ObjectPath, *dbus.Error) {
+	return f.session, nil
+}
+
+// exportFakeLogindSession serves a logind session whose LockedHint changes
+// are only announced when the test emits them.
+func exportFakeLogindSession(t *testing.T, conn *dbus.Conn, path dbus.ObjectPath) *prop.Properties {
+	t.Helper()
+
+	const iface = "org.freedesktop.login1.Session"
+	session := map[string]map[string]*prop.Prop{iface: {
+		"Id":         {Value: "1", Emit: prop.EmitFalse},
+		"LockedHint": {Value: false, Writable: true, Emit: prop.EmitFalse},
+	}}
+	_, err := prop.Export(conn, "/org/freedesktop/login1/session/auto", session)
+	require.NoError(t, err)
+	props, err := prop.Export(conn, path, session)
+	require.NoError(t, err)
+
+	manager := &fakeLogindManager{session: path}
+	require.NoError(t, conn.Export(manager, "/org/freedesktop/login1", "org.freedesktop.login1.Manager"))
+	_, err = conn.RequestName("org.freedesktop.login1", dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+
+	return props
+}
+
+func TestLockChangedLogind(t *testing.T) {
+	const (
+		iface = "org.freedesktop.login1.Session"
+		path  = dbus.ObjectPath("/org/freedesktop/login1/session/_31")
+	)
+
+	address := startPrivateBus(t)
+	logindConn := connectPrivateBus(t, address)
+	props := exportFakeLogindSession(t, logindConn, path)
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+
+	changes := make(chan bool, 4)
+	s.OnLockChanged(func(locked bool) { changes <- locked })
+
+	expect := func(expected bool) {
+		select {
+		case got := <-changes:
+			require.Equal(t, expected, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("lock change not received")
+		}
+	}
+	expectNone := func() {
+		select {
+		case got := <-changes:
+			t.Fatalf("unexpected lock change %v", got)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	setHint := func(locked, announce bool) {
+		props.SetMust(iface, "LockedHint", locked)
+		if announce {
+			err := logindConn.Emit(path, "org.freedesktop.DBus.Properties.PropertiesChanged", iface,
+				map[string]dbus.Variant{"LockedHint": dbus.MakeVariant(locked)}, []string{})
+			require.NoError(t, err)
+		}
+	}
+	emit := func(member string) {
+		require.NoError(t, logindConn.Emit(path, iface+"."+member))
+	}
+
+	setHint(true, true)
+	expect(true)
+
+	// an unlock request the locker has not acted on leaves the screen locked
+	emit("Unlock")
+	expectNone()
+
+	// requests make the state be read again
+	setHint(false, false)
+	emit("Unlock")
+	expect(false)
+
+	emit("Lock")
+	expectNone()
+}
+
+func TestBrightnessChanged(t *testing.T) {
+	tmp := mockBacklightDir(t)
+	actual := filepath.Join(tmp, "intel_backlight", "actual_brightness")
+	require.NoError(t, os.WriteFile(actual, []byte("20"), 0600))
+
+	address := startPrivateBus(t)
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = s.Close() })
+
+	changes := make(chan int, 4)
+	s.OnBrightnessChanged(func(device string, percent int) {
+		require.Equal(t, "intel_backlight", device)
+		changes <- percent
+	})
+
+	// a burst of writes is reported once with the final value
+	for _, value := range []string{"30", "40", "55"} {
+		require.NoError(t, os.WriteFile(actual, []byte(value), 0600))
+	}
+
+	select {
+	case percent := <-changes:
+		require.Equal(t, 55, percent)
+	case <-time.After(5 * time.Second):
+		t.Fatal("brightness change not received")
+	}
+
+	select {
+	case percent := <-changes:
+		t.Fatalf("unexpected brightness change %d", percent)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestBacklightsPreferenceOrder(t *testing.T) {
+	tmp := t.TempDir()
+	for name, typ := range map[string]string{
+		"acpi_video0":     "firmware",
+		"intel_backlight": "raw",
+		"dell_backlight":  "platform",
+	} {
+		dev := filepath.Join(tmp, name)
+		require.NoError(t, os.Mkdir(dev, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dev, "type"), []byte(typ+"\n"), 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(dev, "max_brightness"), []byte("200"), 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(dev, "brightness"), []byte("50"), 0600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "intel_backlight", "brightness"), []byte("100"), 0600))
+
+	old := deskconn.BacklightBasePath
+	t.Cleanup(func() { deskconn.BacklightBasePath = old })
+	deskconn.BacklightBasePath = tmp
+
+	address := startPrivateBus(t)
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = s.Close() })
+
+	devices := s.Backlights()
+	require.Len(t, devices, 3)
+	require.Equal(t, deskconn.BacklightDevice{
+		Name: "acpi_video0", Type: "firmware", MaxBrightness: 200, Brightness: 50, Default: true,
+	}, devices[0])
+	require.Equal(t, "dell_backlight", devices[1].Name)
+	require.Equal(t, "intel_backlight", devices[2].Name)
+	require.False(t, devices[2].Default)
+
+	brightness, err := s.GetBrightness()
+	require.NoError(t, err)
+	require.Equal(t, 25, brightness)
+
+	brightness, err = s.GetDeviceBrightness("intel_backlight")
+	require.NoError(t, err)
+	require.Equal(t, 50, brightness)
+
+	_, err = s.GetDeviceBrightness("nouveau")
+	require.EqualError(t, err, "backlight device not found: nouveau")
+}
+
+type fakeLogindSession struct {
+	dir      string
+	values   []uint32
+	unlocked bool
+	mu       sync.Mutex
+}
+
+func (f *fakeLogindSession) Unlock() *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.unlocked = true
+	return nil
+}
+
+func (f *fakeLogindSession) Unlocked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.unlocked
+}
+
+func (f *fakeLogindSession) SetBrightness(_, name string, value uint32) *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.values = append(f.values, value)
+	err := os.WriteFile(filepath.Join(f.dir, name, "brightness"), []byte(strconv.Itoa(int(value))), 0600)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (f *fakeLogindSession) Values() []uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]uint32{}, f.values...)
+}
+
+// exportFakeLogind serves SetBrightness on session/auto, writing the values
+// into the backlight directory like logind would.
+func exportFakeLogind(t *testing.T, conn *dbus.Conn, backlightDir string) *fakeLogindSession {
+	t.Helper()
+
+	fake := &fakeLogindSession{dir: backlightDir}
+	require.NoError(t, conn.Export(fake, "/org/freedesktop/login1/session/auto", "org.freedesktop.login1.Session"))
+	_, err := conn.RequestName("org.freedesktop.login1", dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+
+	return fake
+}
+
+func TestFadeBrightness(t *testing.T) {
+	tmp := mockBacklightDir(t)
+	address := startPrivateBus(t)
+	logind := exportFakeLogind(t, connectPrivateBus(t, address), tmp)
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = s.Close() })
+
+	require.NoError(t, s.FadeDeviceBrightness("", 60, 200*time.Millisecond))
+
+	values := logind.Values()
+	require.Greater(t, len(values), 2)
+	require.Equal(t, uint32(60), values[len(values)-1])
+	for i := 1; i < len(values); i++ {
+		require.Greater(t, values[i], values[i-1])
+	}
+}
+
+func TestFadeBrightnessCancelled(t *testing.T) {
+	tmp := mockBacklightDir(t)
+	address := startPrivateBus(t)
+	logind := exportFakeLogind(t, connectPrivateBus(t, address), tmp)
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	t.Cleanup(func() { _ = s.Close() })
+
+	done := make(chan error, 1)
+	go func() { done <- s.FadeDeviceBrightness("", 100, 5*time.Second) }()
+
+	require.Eventually(t, func() bool { return len(logind.Values()) > 0 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.SetBrightness(10))
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("fade was not cancelled")
+	}
+
+	brightness, err := s.GetBrightness()
+	require.NoError(t, err)
+	require.Equal(t, 10, brightness)
+}
+
+func TestUnlockProvider(t *testing.T) {
+	address := startPrivateBus(t)
+	fake := exportFakeScreenSaver(t, connectPrivateBus(t, address))
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	require.Equal(t, deskconn.LockInfo{
+		Service:           "org.freedesktop.ScreenSaver",
+		IsLockedSupported: true,
+		UnlockSupported:   true,
+	}, s.LockInfo())
+
+	require.NoError(t, s.Lock())
+	require.True(t, fake.active.Load())
+
+	require.NoError(t, s.Unlock())
+	require.False(t, fake.active.Load())
+}
+
+func TestUnlockLogind(t *testing.T) {
+	address := startPrivateBus(t)
+	logind := exportFakeLogind(t, connectPrivateBus(t, address), t.TempDir())
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	require.Equal(t, deskconn.LockInfo{UnlockSupported: true}, s.LockInfo())
+
+	require.NoError(t, s.Unlock())
+	require.True(t, logind.Unlocked())
+}
+
+func TestLockProviderRedetected(t *testing.T) {
+	address := startPrivateBus(t)
+
+	s := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	require.Equal(t, deskconn.LockInfo{}, s.LockInfo())
+	require.EqualError(t, s.Lock(), "screen lock provider not initialized")
+
+	// the desktop shell claims its name after deskconnd started
+	providerConn := connectPrivateBus(t, address)
+	fake := exportFakeScreenSaver(t, providerConn)
+
+	require.Eventually(t, func() bool {
+		return s.LockInfo().Service == "org.freedesktop.ScreenSaver"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Lock())
+	require.True(t, fake.active.Load())
+
+	changes := make(chan bool, 1)
+	s.OnLockChanged(func(locked bool) { changes <- locked })
+	err := providerConn.Emit("/ScreenSaver", "org.freedesktop.ScreenSaver.ActiveChanged", true)
+	require.NoError(t, err)
+	select {
+	case locked := <-changes:
+		require.True(t, locked)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock change from late provider not received")
+	}
+
+	_, err = providerConn.ReleaseName("org.freedesktop.ScreenSaver")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return s.LockInfo().Service == ""
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,44 @@
+package deskconn
+
+// scrollback is a fixed size ring buffer holding the most recent output of a
+// shell, replayed to clients when they reattach.
+type scrollback struct {
+	data   []byte
+	start  int
+	length int
+}
+
+func newScrollback(size int) *scrollback {
+	return &scrollback{data: make([]byte, max(size, 0))}
+}
+
+func (s *scrollback) Write(p []byte) {
+	size := len(s.data)
+	if size == 0 {
+		return
+	}
+
+	if len(p) >= size {
+		copy(s.data, p[len(p)-size:])
+		s.start, s.length = 0, size
+		return
+	}
+
+	end := (s.start + s.length) % size
+	n := copy(s.data[end:], p)
+	copy(s.data, p[n:])
+
+	s.length += len(p)
+	if s.length > size {
+		s.start = (s.start + s.length - size) % size
+		s.length = size
+	}
+}
+
+// Bytes returns a copy of the buffered output, oldest first.
+func (s *scrollback) Bytes() []byte {
+	out := make([]byte, s.length)
+	n := copy(out, s.data[s.start:min(s.start+s.length, len(s.data))])
+	copy(out[n:], s.data[:s.length-n])
+	return out
+}
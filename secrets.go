@@ -0,0 +1,201 @@
+package deskconn
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	secretServiceName       = "org.freedesktop.secrets"
+	secretServicePath       = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretDefaultCollection = dbus.ObjectPath("/org/freedesktop/secrets/aliases/default")
+	secretServiceIface      = "org.freedesktop.Secret.Service"
+	secretCollectionIface   = "org.freedesktop.Secret.Collection"
+	secretItemIface         = "org.freedesktop.Secret.Item"
+	secretPromptIface       = "org.freedesktop.Secret.Prompt"
+
+	// secretNoPrompt is returned instead of a prompt when the service needs
+	// no confirmation from the user.
+	secretNoPrompt = dbus.ObjectPath("/")
+)
+
+// secret is the Secret structure of the Secret Service API.
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// secretService is a session with the Secret Service of the user, through
+// which private keys are kept in the keyring.
+type secretService struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+func openSecretService() (*secretService, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+
+	// Secrets travel over the session bus, which only the user can reach,
+	// so the plain algorithm is enough.
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err = conn.Object(secretServiceName, secretServicePath).
+		Call(secretServiceIface+".OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &session)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("secret service not available: %w", err)
+	}
+
+	return &secretService{conn: conn, session: session}, nil
+}
+
+func (s *secretService) close() {
+	_ = s.conn.Object(secretServiceName, s.session).Call("org.freedesktop.Secret.Session.Close", 0).Err
+	_ = s.conn.Close()
+}
+
+func secretAttributes(authID, publicKey string) map[string]string {
+	return map[string]string{
+		"application": "deskconn",
+		"auth_id":     authID,
+		"public_key":  publicKey,
+	}
+}
+
+// store keeps a private key in the default collection, replacing the one
+// stored for the same key pair.
+func (s *secretService) store(authID, publicKey, privateKey string) error {
+	properties := map[string]dbus.Variant{
+		secretItemIface + ".Label":      dbus.MakeVariant("deskconn private key for " + authID),
+		secretItemIface + ".Attributes": dbus.MakeVariant(secretAttributes(authID, publicKey)),
+	}
+	value := secret{
+		Session:     s.session,
+		Value:       []byte(privateKey),
+		ContentType: "text/plain",
+	}
+
+	var item, prompt dbus.ObjectPath
+	err := s.conn.Object(secretServiceName, secretDefaultCollection).
+		Call(secretCollectionIface+".CreateItem", 0, properties, value, true).Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("failed to store private key in secret service: %w", err)
+	}
+
+	_, err = s.prompt(prompt)
+	return err
+}
+
+// lookup returns the private key stored for a key pair, unlocking it if
+// needed.
+func (s *secretService) lookup(authID, publicKey string) (string, error) {
+	items, err := s.search(authID, publicKey, true)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", fmt.Errorf("private key not found in secret service")
+	}
+
+	var value secret
+	err = s.conn.Object(secretServiceName, items[0]).Call(secretItemIface+".GetSecret", 0, s.session).Store(&value)
+	if err != nil {
+		return "", fmt.Errorf("failed to read private key from secret service: %w", err)
+	}
+	return string(value.Value), nil
+}
+
+// remove deletes the private key stored for a key pair, if any.
+func (s *secretService) remove(authID, publicKey string) error {
+	items, err := s.search(authID, publicKey, false)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+		if err := s.conn.Object(secretServiceName, item).Call(secretItemIface+".Delete", 0).Store(&prompt); err != nil {
+			return fmt.Errorf("failed to remove private key from secret service: %w", err)
+		}
+		if _, err := s.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// search finds the items stored for a key pair, unlocking locked ones when
+// asked to.
+func (s *secretService) search(authID, publicKey string, unlock bool) ([]dbus.ObjectPath, error) {
+	service := s.conn.Object(secretServiceName, secretServicePath)
+
+	var unlocked, locked []dbus.ObjectPath
+	err := service.Call(secretServiceIface+".SearchItems", 0, secretAttributes(authID, publicKey)).
+		Store(&unlocked, &locked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search secret service: %w", err)
+	}
+	if !unlock || len(locked) == 0 {
+		return append(unlocked, locked...), nil
+	}
+
+	var prompt dbus.ObjectPath
+	var now []dbus.ObjectPath
+	if err := service.Call(secretServiceIface+".Unlock", 0, locked).Store(&now, &prompt); err != nil {
+		return nil, fmt.Errorf("failed to unlock secret service: %w", err)
+	}
+	result, err := s.prompt(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if paths, ok := result.Value().([]dbus.ObjectPath); ok {
+		now = append(now, paths...)
+	}
+
+	return append(unlocked, now...), nil
+}
+
+// prompt lets the service ask the user to confirm an operation, such as
+// unlocking the keyring, and waits for the answer.
+func (s *secretService) prompt(prompt dbus.ObjectPath) (dbus.Variant, error) {
+	if prompt == "" || prompt == secretNoPrompt {
+		return dbus.Variant{}, nil
+	}
+
+	options := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(secretPromptIface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := s.conn.AddMatchSignal(options...); err != nil {
+		return dbus.Variant{}, err
+	}
+	defer func() { _ = s.conn.RemoveMatchSignal(options...) }()
+
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.conn.Object(secretServiceName, prompt).Call(secretPromptIface+".Prompt", 0, "").Err; err != nil {
+		return dbus.Variant{}, fmt.Errorf("failed to prompt for secret service: %w", err)
+	}
+
+	for signal := range signals {
+		if signal.Path != prompt || signal.Name != secretPromptIface+".Completed" || len(signal.Body) != 2 {
+			continue
+		}
+		if dismissed, _ := signal.Body[0].(bool); dismissed {
+			return dbus.Variant{}, fmt.Errorf("secret service prompt dismissed")
+		}
+		result, _ := signal.Body[1].(dbus.Variant)
+		return result, nil
+	}
+
+	return dbus.Variant{}, fmt.Errorf("session bus closed while waiting for secret service prompt")
+}
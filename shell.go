@@ -3,14 +3,20 @@ package deskconn
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/creack/pty"
 	"golang.org/x/term"
@@ -18,120 +24,851 @@ import (
 	"github.com/xconnio/xconn-go"
 )
 
+const (
+	// shellIDWait bounds how long a client waits for the server to announce the
+	// id of a new shell before sending input without it, as older servers never do.
+	shellIDWait = 5 * time.Second
+
+	defaultShellGracePeriod = 5 * time.Minute
+	defaultShellScrollback  = 64 * 1024
+)
+
+var errShellEnded = errors.New("shell has ended")
+
+// notOwned refuses a call on a shell started by another user. Only the owner
+// of a shell may see it listed, attach to it, type into it or kill it; others
+// can at most watch it.
+func notOwned(id string) *xconn.InvocationResult {
+	return xconn.NewInvocationError(ErrNotAuthorized, fmt.Sprintf("shell %q belongs to another user", id))
+}
+
+// shell is a PTY started on behalf of a caller. Output is streamed to the
+// invocation that is currently attached to it; without one the shell keeps
+// running for a grace period so the client can resume it.
+type shell struct {
+	id      string
+	authID  string
+	cmd     *exec.Cmd
+	ptmx    *os.File
+	started time.Time
+	grace   time.Duration
+
+	caller   callerKey
+	owner    *outputStream
+	watchers map[callerKey]*watcher
+	// drained is signalled when the attached client acknowledges output or
+	// goes away, for output waiting for room in its window.
+	drained    *sync.Cond
+	shareWrite bool
+	scrollback *scrollback
+	expiry     *time.Timer
+	closed     bool
+	// ended is set once the exit status has been sent, after which no call
+	// is sent anything more.
+	ended   bool
+	winsize pty.Winsize
+
+	recorder *recorder
+
+	idleTimeout   time.Duration
+	lastActivity  time.Time
+	idleWarned    bool
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+	// reason tells the client why the shell was closed on its behalf.
+	reason string
+	sync.Mutex
+}
+
+// attach makes the given call the receiver of the shell's output, announcing
+// the shell id along with the scrollback, and returns the previously attached
+// call, if any.
+func (s *shell) attach(caller callerKey, authID string, stream *outputStream, replay bool) (
+	xconn.SendProgress, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ended {
+		return nil, errShellEnded
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+
+	var previous xconn.SendProgress
+	if s.owner != nil {
+		previous = s.owner.sink
+	}
+	s.caller = caller
+	s.owner = stream
+	s.recorder.mark("attached by " + authID)
+	s.drained.Broadcast()
+
+	// The announcement always carries a chunk, so clients that predate shell
+	// ids do not mistake it for the end of the session.
+	output := []byte{}
+	if replay {
+		output = s.scrollback.Bytes()
+	}
+	var packed []byte
+	if err := stream.send(output, map[string]any{"id": s.id}, &packed); err != nil {
+		s.detachLocked()
+	}
+
+	return previous, nil
+}
+
+// output records a chunk of terminal output and forwards it to the attached
+// call and the watchers, once the attached call has room for it. Holding the
+// lock while sending keeps replays and live output in order.
+func (s *shell) output(chunk []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	for !s.closed && s.owner != nil && !s.owner.ready() {
+		s.drained.Wait()
+	}
+
+	s.touchLocked()
+	s.emit(chunk)
+}
+
+// ack records output the caller has consumed.
+func (s *shell) ack(caller callerKey, n int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.owner != nil && s.caller == caller {
+		s.owner.ack(n)
+	} else if w, ok := s.watchers[caller]; ok {
+		w.ack(n)
+	}
+	s.drained.Broadcast()
+}
+
+// emit must be called with the lock held.
+func (s *shell) emit(chunk []byte) {
+	s.scrollback.Write(chunk)
+	s.recorder.output(chunk)
+	s.deliver(chunk)
+}
+
+// end tells the attached client that the shell is gone, along with how it
+// exited.
+func (s *shell) end(state *os.ProcessState) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+
+	status := exitStatus(state)
+	if s.reason != "" {
+		status = mergeKwargs(status, map[string]any{"reason": s.reason})
+	}
+
+	if s.owner != nil {
+		_ = s.owner.sink(nil, status)
+	}
+	for _, w := range s.watchers {
+		_ = w.sink(nil, status)
+	}
+
+	s.ended = true
+	s.caller = callerKey{}
+	s.owner = nil
+	clear(s.watchers)
+}
+
+// exitStatus describes how a process ended, using the 128+n convention of
+// shells for processes killed by a signal.
+func exitStatus(state *os.ProcessState) map[string]any {
+	if state == nil {
+		return nil
+	}
+
+	status := map[string]any{"exit_code": state.ExitCode()}
+	if waitStatus, ok := state.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+		status["exit_code"] = 128 + int(waitStatus.Signal())
+		status["signal"] = waitStatus.Signal().String()
+	}
+	return status
+}
+
+// deliver sends to the attached call and all watchers. It must be called with
+// the lock held. Failing to deliver means the client is gone, so the shell is
+// detached from it. Watchers never hold up the shell: one a whole window
+// behind is detached instead, as dropping output would garble its terminal.
+func (s *shell) deliver(chunk []byte) {
+	var packed []byte
+	if s.owner != nil {
+		if err := s.owner.send(chunk, nil, &packed); err != nil {
+			s.detachLocked()
+		}
+	}
+
+	for caller, w := range s.watchers {
+		if !w.ready() {
+			_ = w.sink(nil, map[string]any{"reason": "lagging"})
+			s.unwatchLocked(caller)
+		} else if err := w.send(chunk, nil, &packed); err != nil {
+			s.unwatchLocked(caller)
+		}
+	}
+}
+
+// release stops sending output to the caller ahead of its call completing,
+// as progress for a finished call confuses clients. It reports whether the
+// caller was the one attached.
+func (s *shell) release(caller callerKey) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.owner == nil || s.caller != caller {
+		return false
+	}
+
+	s.caller = callerKey{}
+	s.owner = nil
+	s.drained.Broadcast()
+	return true
+}
+
+// callers returns the attached caller and the watchers of the shell.
+func (s *shell) callers() []callerKey {
+	s.Lock()
+	defer s.Unlock()
+
+	callers := make([]callerKey, 0, len(s.watchers)+1)
+	if s.owner != nil {
+		callers = append(callers, s.caller)
+	}
+	for caller := range s.watchers {
+		callers = append(callers, caller)
+	}
+	return callers
+}
+
+// detach leaves the shell running without a client if the caller is the one
+// attached, reporting whether it was.
+func (s *shell) detach(caller callerKey) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.owner == nil || s.caller != caller {
+		return false
+	}
+
+	s.detachLocked()
+	return true
+}
+
+func (s *shell) detachLocked() {
+	s.caller = callerKey{}
+	s.owner = nil
+	s.drained.Broadcast()
+	s.recorder.mark("detached")
+	if s.expiry == nil {
+		s.expiry = time.AfterFunc(s.grace, func() { _ = s.close() })
+	}
+}
+
+func (s *shell) resize(winsize *pty.Winsize) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	_ = pty.Setsize(s.ptmx, winsize)
+	if *winsize != s.winsize {
+		s.winsize = *winsize
+		s.recorder.resize(winsize.Cols, winsize.Rows)
+	}
+}
+
+// signal sends a signal to the foreground process group of the shell, as
+// typing an interrupt would, falling back to the shell's own group.
+func (s *shell) signal(sig syscall.Signal) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("shell %s is closed", s.id)
+	}
+	s.recorder.mark("signal: " + sig.String())
+
+	pgrp, err := foregroundProcessGroup(s.ptmx)
+	if err != nil || pgrp <= 0 {
+		pgrp = s.cmd.Process.Pid
+	}
+	return syscall.Kill(-pgrp, sig)
+}
+
+func foregroundProcessGroup(ptmx *os.File) (int, error) {
+	conn, err := ptmx.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var pgrp int32
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP,
+			uintptr(unsafe.Pointer(&pgrp))) // #nosec G103
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(pgrp), nil
+}
+
+// close hangs up the shell. The PTY is closed under the lock so that it never
+// races with a resize.
+func (s *shell) close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.stopLimits()
+	s.drained.Broadcast()
+
+	err := s.ptmx.Close()
+	if s.cmd.Process != nil {
+		_ = s.cmd.Process.Signal(syscall.SIGHUP)
+	}
+	return err
+}
+
+// ownedBy reports whether the shell was started by the given authid.
+func (s *shell) ownedBy(authID string) bool {
+	return s.authID == authID
+}
+
+func (s *shell) info() map[string]any {
+	s.Lock()
+	defer s.Unlock()
+
+	return map[string]any{
+		"id":       s.id,
+		"pid":      s.cmd.Process.Pid,
+		"authid":   s.authID,
+		"caller":   s.caller.session,
+		"attached": s.owner != nil,
+		"watchers": len(s.watchers),
+		"started":  s.started.Unix(),
+	}
+}
+
 type interactiveShellSession struct {
-	ptmx map[uint64]*os.File
+	shells map[string]*shell
+	// latest remembers the most recent shell of each caller, for clients that
+	// do not send the shell id along with their input.
+	latest map[callerKey]string
+	// unfollowed holds the routers on which callers cannot be seen leaving.
+	unfollowed map[*xconn.Session]bool
+
+	config         ShellConfig
+	gracePeriod    time.Duration
+	scrollbackSize int
+	recording      ShellRecording
+	recordings     *activeRecordings
+	idleTimeout    time.Duration
+	maxLifetime    time.Duration
 	sync.Mutex
 }
 
 func newInteractiveShellSession() *interactiveShellSession {
 	return &interactiveShellSession{
-		ptmx: make(map[uint64]*os.File),
+		shells:         make(map[string]*shell),
+		latest:         make(map[callerKey]string),
+		unfollowed:     make(map[*xconn.Session]bool),
+		gracePeriod:    defaultShellGracePeriod,
+		scrollbackSize: defaultShellScrollback,
+		recordings:     newActiveRecordings(),
 	}
 }
 
-func (p *interactiveShellSession) startPtySession(inv *xconn.Invocation) (*os.File, error) {
-	cmd := exec.Command("bash")
-	ptmx, err := pty.Start(cmd)
+func (p *interactiveShellSession) setConfig(config ShellConfig) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.config = config
+}
+
+func (p *interactiveShellSession) setGracePeriod(grace time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.gracePeriod = grace
+}
+
+func (p *interactiveShellSession) setScrollbackSize(size int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.scrollbackSize = size
+}
+
+func (p *interactiveShellSession) setLimits(idleTimeout, maxLifetime time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.idleTimeout = idleTimeout
+	p.maxLifetime = maxLifetime
+}
+
+// detachCaller keeps the shells of a caller that left running, so they can be
+// resumed within the grace period.
+func (p *interactiveShellSession) detachCaller(caller callerKey) {
+	p.Lock()
+	shells := make([]*shell, 0, len(p.shells))
+	for _, sh := range p.shells {
+		shells = append(shells, sh)
+	}
+	delete(p.latest, caller)
+	p.Unlock()
+
+	for _, sh := range shells {
+		sh.unwatch(caller)
+		if sh.detach(caller) {
+			log.Printf("Shell %s detached, closing in %v unless resumed", sh.id, sh.grace)
+		}
+	}
+}
+
+// unfollowRouter marks a router on which callers leaving go unnoticed.
+func (p *interactiveShellSession) unfollowRouter(router *xconn.Session) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.unfollowed[router] = true
+}
+
+// detachRouter detaches every caller that reached the shells through the
+// router.
+func (p *interactiveShellSession) detachRouter(router *xconn.Session) {
+	p.Lock()
+	delete(p.unfollowed, router)
+	shells := make([]*shell, 0, len(p.shells))
+	for _, sh := range p.shells {
+		shells = append(shells, sh)
+	}
+	callers := make(map[callerKey]struct{})
+	for caller := range p.latest {
+		callers[caller] = struct{}{}
+	}
+	p.Unlock()
+
+	for _, sh := range shells {
+		for _, caller := range sh.callers() {
+			callers[caller] = struct{}{}
+		}
+	}
+	for caller := range callers {
+		if caller.router == router {
+			p.detachCaller(caller)
+		}
+	}
+}
+
+func newShellID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// startPtySession starts a shell for the caller, sized to the terminal of the
+// client if it sent one.
+func (p *interactiveShellSession) startPtySession(inv *xconn.Invocation, caller callerKey,
+	winsize *pty.Winsize) (*shell, error) {
+	id, err := newShellID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate shell id: %w", err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	cmd, err := p.config.command(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	sh := &shell{
+		id:         id,
+		authID:     inv.CallerAuthID(),
+		cmd:        cmd,
+		started:    time.Now(),
+		grace:      p.gracePeriod,
+		scrollback: newScrollback(p.scrollbackSize),
+		watchers:   make(map[callerKey]*watcher),
+		winsize:    pty.Winsize{Cols: defaultRecordingCols, Rows: defaultRecordingRows},
+	}
+	sh.drained = sync.NewCond(&sh.Mutex)
+	if winsize != nil {
+		sh.winsize = *winsize
+	}
+
+	sh.recorder, err = p.startRecording(sh, sh.winsize.Cols, sh.winsize.Rows)
 	if err != nil {
+		return nil, fmt.Errorf("failed to start shell recording: %w", err)
+	}
+
+	if winsize != nil {
+		sh.ptmx, err = pty.StartWithSize(cmd, winsize)
+	} else {
+		sh.ptmx, err = pty.Start(cmd)
+	}
+	if err != nil {
+		sh.recorder.mark("failed to start: " + err.Error())
+		sh.recorder.close()
 		return nil, fmt.Errorf("failed to start PTY: %w", err)
 	}
+	p.shells[id] = sh
+	p.latest[caller] = id
+	idleTimeout := p.idleTimeout
+	if idleTimeout == 0 && p.unfollowed[caller.router] {
+		// The shell is never detached when its caller goes away, so it is
+		// closed once unused for as long as a detached one would be kept.
+		idleTimeout = p.gracePeriod
+	}
+	sh.startLimits(idleTimeout, p.maxLifetime)
+
+	go p.startOutputReader(sh)
+
+	return sh, nil
+}
+
+func (p *interactiveShellSession) startOutputReader(sh *shell) {
+	chunks := make(chan []byte, shellReadQueue)
+	go readOutput(sh.ptmx, chunks)
+	for chunk := range chunks {
+		sh.output(batchOutput(chunk, chunks))
+	}
+
+	if err := sh.close(); err != nil {
+		log.Printf("Error closing PTY of shell %s: %v", sh.id, err)
+	}
+
+	// The exit status is only known once the shell has been waited for. The
+	// shell is kept until then, so that calls ending meanwhile are released
+	// rather than sent the status after they completed.
+	_ = sh.cmd.Wait()
+	sh.end(sh.cmd.ProcessState)
+	sh.recorder.close()
+
 	p.Lock()
-	p.ptmx[inv.Caller()] = ptmx
+	delete(p.shells, sh.id)
+	for caller, id := range p.latest {
+		if id == sh.id {
+			delete(p.latest, caller)
+		}
+	}
 	p.Unlock()
+}
 
-	go p.startOutputReader(inv, ptmx)
+func (p *interactiveShellSession) shell(id string) *shell {
+	p.Lock()
+	defer p.Unlock()
 
-	return ptmx, nil
+	return p.shells[id]
 }
 
-func (p *interactiveShellSession) startOutputReader(inv *xconn.Invocation, ptmx *os.File) {
-	caller := inv.Caller()
-	defer func() {
-		p.Lock()
-		delete(p.ptmx, caller)
-		p.Unlock()
-		if err := ptmx.Close(); err != nil {
-			log.Printf("Error closing PTY for caller %d: %v", caller, err)
-		}
-	}()
-	buf := make([]byte, 4096)
-	for {
-		n, err := ptmx.Read(buf)
-		if n > 0 {
-			_ = inv.SendProgress([]any{buf[:n]}, nil)
+// lookup finds the shell a message belongs to, either by the id it carries or,
+// for older clients, by the most recent shell started by the caller.
+func (p *interactiveShellSession) lookup(inv *xconn.Invocation, caller callerKey) *shell {
+	p.Lock()
+	defer p.Unlock()
+
+	id, ok := inv.Kwargs()["id"].(string)
+	if !ok {
+		id = p.latest[caller]
+	}
+
+	return p.shells[id]
+}
+
+// isNewCall reports whether the invocation is the first message of a call,
+// the only one in which the caller asks to receive progressive results.
+func isNewCall(inv *xconn.Invocation) bool {
+	receiveProgress, _ := inv.Details()["receive_progress"].(bool)
+	return receiveProgress
+}
+
+func (p *interactiveShellSession) apply(sh *shell, caller callerKey, frame *shellFrame) *xconn.InvocationResult {
+	if frame.kind == shellFrameAck {
+		sh.ack(caller, frame.acked)
+		return xconn.NewInvocationError(xconn.ErrNoResult)
+	}
+	if frame.kind != shellFrameResize {
+		sh.touch()
+	}
+
+	var err error
+	switch frame.kind {
+	case shellFrameData:
+		if len(frame.data) > 0 {
+			_, err = sh.ptmx.Write(frame.data)
 		}
-		if err != nil {
-			_ = inv.SendProgress(nil, nil)
-			return
+	case shellFrameResize:
+		if frame.winsize != nil {
+			sh.resize(frame.winsize)
 		}
+	case shellFrameSignal:
+		err = sh.signal(frame.signal)
+	case shellFrameEOF:
+		_, err = sh.ptmx.Write([]byte{shellEOF})
 	}
+
+	if err != nil {
+		return xconn.NewInvocationError("io.xconn.error", err.Error())
+	}
+	return xconn.NewInvocationError(xconn.ErrNoResult)
+}
+
+// closeFor ends the shell a final message refers to, unless the shell has
+// since been attached to by another caller.
+func (p *interactiveShellSession) closeFor(inv *xconn.Invocation, caller callerKey) *xconn.InvocationResult {
+	if sh := p.lookup(inv, caller); sh != nil && sh.release(caller) {
+		_ = sh.close()
+	}
+
+	return xconn.NewInvocationResult()
 }
 
 func (p *interactiveShellSession) handleShell() func(_ context.Context,
 	inv *xconn.Invocation) *xconn.InvocationResult {
-	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
-		caller := inv.Caller()
+	return func(ctx context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		caller := callerOf(ctx, inv)
+		if !inv.Progress() {
+			return p.closeFor(inv, caller)
+		}
 
-		p.Lock()
-		ptmx, exists := p.ptmx[caller]
-		p.Unlock()
+		frame, err := parseShellFrame(inv)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
 
-		if inv.Progress() {
-			payload, err := inv.ArgBytes(0)
-			if err != nil {
-				return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		var sh *shell
+		if isNewCall(inv) {
+			sh, err = p.startPtySession(inv, caller, frame.winsize)
+			if errors.Is(err, errShellCommandNotAllowed) || errors.Is(err, errShellDirNotAllowed) {
+				return xconn.NewInvocationError(ErrNotAuthorized, err.Error())
+			} else if err != nil {
+				return xconn.NewInvocationError("io.xconn.error", err.Error())
 			}
+			sh.shareInput(inv.KwargBoolOr("share_write", false))
+			_, _ = sh.attach(caller, inv.CallerAuthID(), newOutputStream(inv), true)
+		} else if sh = p.lookup(inv, caller); sh == nil {
+			return unknownShell(inv, "")
+		} else if !sh.ownedBy(inv.CallerAuthID()) {
+			// Input for a shell of another user is dropped. Refusing it would
+			// end the call while the caller's own shell still streams to it.
+			return xconn.NewInvocationError(xconn.ErrNoResult)
+		}
 
-			if bytes.HasPrefix(payload, []byte("SIZE:")) {
-				var cols, rows int
-				n, _ := fmt.Sscanf(string(payload), "SIZE:%d:%d", &cols, &rows)
-				if n == 2 {
-					if cols < 0 || cols > math.MaxUint16 || rows < 0 || rows > math.MaxUint16 {
-						return xconn.NewInvocationError("wamp.error.invalid_argument", "invalid size")
-					}
-					if !exists {
-						newPt, err := p.startPtySession(inv)
-						if err != nil {
-							return xconn.NewInvocationError("io.xconn.error", err.Error())
-						}
-						ptmx = newPt
-					}
-					winsize := &pty.Winsize{
-						Cols: uint16(cols), // #nosec G115
-						Rows: uint16(rows), // #nosec G115
-					}
-					_ = pty.Setsize(ptmx, winsize)
-				}
-				return xconn.NewInvocationError(xconn.ErrNoResult)
-			}
+		return p.apply(sh, caller, frame)
+	}
+}
 
-			if !exists {
-				newPt, err := p.startPtySession(inv)
-				if err != nil {
-					return xconn.NewInvocationError("io.xconn.error", err.Error())
-				}
-				ptmx = newPt
-			}
+func (p *interactiveShellSession) handleShellAttach() func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(ctx context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		id, err := inv.KwargString("id")
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", "shell id is required")
+		}
+
+		caller := callerOf(ctx, inv)
+		// The shell may have exited by the time the client ends its call.
+		if !inv.Progress() {
+			return p.closeFor(inv, caller)
+		}
 
-			_, err = ptmx.Write(payload)
+		sh := p.shell(id)
+		if sh == nil {
+			return unknownShell(inv, id)
+		}
+		if !sh.ownedBy(inv.CallerAuthID()) {
+			return notOwned(id)
+		}
+
+		if isNewCall(inv) {
+			sh.shareInput(inv.KwargBoolOr("share_write", false))
+			previous, err := sh.attach(caller, inv.CallerAuthID(), newOutputStream(inv),
+				inv.KwargBoolOr("replay", true))
 			if err != nil {
-				return xconn.NewInvocationError("io.xconn.error", err.Error())
+				return unknownShell(inv, id)
 			}
-			return xconn.NewInvocationError(xconn.ErrNoResult)
+			if previous != nil {
+				_ = previous(nil, map[string]any{"reason": "detached"})
+			}
+		}
+
+		frame, err := parseShellFrame(inv)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
 		}
 
+		return p.apply(sh, caller, frame)
+	}
+}
+
+func (p *interactiveShellSession) handleShellList() func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
 		p.Lock()
-		if stored, ok := p.ptmx[caller]; ok {
-			_ = stored.Close()
-			delete(p.ptmx, caller)
+		shells := make([]*shell, 0, len(p.shells))
+		for _, sh := range p.shells {
+			if sh.ownedBy(inv.CallerAuthID()) {
+				shells = append(shells, sh)
+			}
 		}
 		p.Unlock()
 
+		sort.Slice(shells, func(i, j int) bool { return shells[i].started.Before(shells[j].started) })
+
+		result := make([]any, 0, len(shells))
+		for _, sh := range shells {
+			result = append(result, sh.info())
+		}
+
+		return xconn.NewInvocationResult(result...)
+	}
+}
+
+func (p *interactiveShellSession) handleShellKill() func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		id, err := inv.KwargString("id")
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", "shell id is required")
+		}
+
+		sh := p.shell(id)
+		if sh == nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", fmt.Sprintf("unknown shell %q", id))
+		}
+		if !sh.ownedBy(inv.CallerAuthID()) {
+			return notOwned(id)
+		}
+
+		_ = sh.close()
 		return xconn.NewInvocationResult()
 	}
 }
 
 func StartInteractiveShell(session *xconn.Session, procedure string) error {
+	return StartInteractiveShellWithOptions(session, procedure, ShellOptions{})
+}
+
+// StartInteractiveShellWithOptions starts a shell like StartInteractiveShell,
+// asking the desktop for a specific command, directory or environment.
+func StartInteractiveShellWithOptions(session *xconn.Session, procedure string, options ShellOptions) error {
+	return runInteractiveShell(session, procedure, "", options.kwargs(), false)
+}
+
+// ResumeInteractiveShell reattaches the terminal to a shell that is still
+// running on the desktop, replaying its recent output first. The procedure is
+// the shell attach procedure of the desktop.
+func ResumeInteractiveShell(session *xconn.Session, procedure, id string) error {
+	return runInteractiveShell(session, procedure, id, map[string]any{"id": id}, false)
+}
+
+// WatchInteractiveShell follows a shell that another client is attached to,
+// showing the same output. Input is only sent with write, which the attached
+// client must have allowed; otherwise Ctrl-C or Ctrl-D stops watching. The
+// procedure is the shell watch procedure of the desktop.
+func WatchInteractiveShell(session *xconn.Session, procedure, id string, write bool) error {
+	return runInteractiveShell(session, procedure, id, map[string]any{"id": id, "write": write}, !write)
+}
+
+func mergeKwargs(kwargs, extra map[string]any) map[string]any {
+	if kwargs == nil {
+		kwargs = make(map[string]any, len(extra))
+	}
+	for name, value := range extra {
+		kwargs[name] = value
+	}
+	return kwargs
+}
+
+// ShellExitError reports that a remote shell exited with a non-zero status.
+type ShellExitError struct {
+	Code int
+	// Signal names the signal that killed the shell, if any.
+	Signal string
+}
+
+func (e *ShellExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("shell terminated by signal: %s", e.Signal)
+	}
+	return fmt.Sprintf("shell exited with status %d", e.Code)
+}
+
+// readStdin forwards terminal input as data frames until stop is closed, or
+// with readOnly only waits for Ctrl-C or Ctrl-D to stop. The input is read
+// through a non-blocking duplicate of stdin, so that the read in progress can
+// be interrupted when the shell ends.
+func readStdin(frames chan<- *xconn.Progress, stop <-chan struct{}, closed func(), readOnly bool) (func(), error) {
+	fd, err := syscall.Dup(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	input := os.NewFile(uintptr(fd), os.Stdin.Name())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1024)
+		for {
+			n, err := input.Read(buf)
+			if err != nil || readOnly && bytes.ContainsAny(buf[:n], "\x03\x04") {
+				closed()
+				return
+			}
+			if readOnly {
+				continue
+			}
+			select {
+			case frames <- newDataFrame(bytes.Clone(buf[:n])):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		_ = input.SetReadDeadline(time.Now())
+		<-done
+		// The flag is shared with stdin itself, so it is cleared before
+		// handing the terminal back.
+		_ = syscall.SetNonblock(fd, false)
+		_ = input.Close()
+	}, nil
+}
+
+func runInteractiveShell(session *xconn.Session, procedure, resume string, kwargs map[string]any,
+	readOnly bool) error {
 	fd := int(os.Stdin.Fd())
 	oldState, err := term.MakeRaw(fd)
 	if err != nil {
@@ -140,61 +877,164 @@ func StartInteractiveShell(session *xconn.Session, procedure string) error {
 	defer func() { _ = term.Restore(fd, oldState) }()
 
 	progressChan := make(chan *xconn.Progress, 32)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	finish := func() { stopOnce.Do(func() { close(stop) }) }
 
 	sendSize := func() *xconn.Progress {
 		width, height, err := term.GetSize(fd)
 		if err != nil {
 			return nil
 		}
-		msg := fmt.Sprintf("SIZE:%d:%d", width, height)
-		return xconn.NewProgress(msg)
+		return newResizeFrame(width, height)
 	}
 
 	if p := sendSize(); p != nil {
 		progressChan <- p
 	}
 
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGWINCH)
+	resized := make(chan struct{})
 	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGWINCH)
-		for range sigChan {
-			if p := sendSize(); p != nil {
-				progressChan <- p
-			}
-		}
-	}()
-
-	go func() {
-		buf := make([]byte, 1024)
+		defer close(resized)
 		for {
-			n, err := os.Stdin.Read(buf)
-			if err != nil {
-				close(progressChan)
+			select {
+			case <-sigChan:
+				if p := sendSize(); p != nil {
+					select {
+					case progressChan <- p:
+					case <-stop:
+						return
+					}
+				}
+			case <-stop:
 				return
 			}
-			progressChan <- xconn.NewProgress(buf[:n])
 		}
 	}()
+	defer func() {
+		finish()
+		signal.Stop(sigChan)
+		<-resized
+	}()
+
+	stopReading, err := readStdin(progressChan, stop, finish, readOnly)
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+	defer func() {
+		finish()
+		stopReading()
+	}()
+
+	// Everything after the first message names the shell it is meant for, so
+	// several terminals can share one connection.
+	var shellID string
+	announced := make(chan struct{})
+	var announce sync.Once
+	if resume != "" {
+		shellID = resume
+		announce.Do(func() { close(announced) })
+	}
+	first := true
+
+	// status is how the remote side ended the session, nil while it has not.
+	var status *xconn.ProgressResult
+	consumed := 0
 
 	call := session.Call(procedure).
 		ProgressSender(func(ctx context.Context) *xconn.Progress {
-			p, ok := <-progressChan
-			if !ok {
-				return xconn.NewFinalProgress()
+			var p *xconn.Progress
+			select {
+			case p = <-progressChan:
+			case <-stop:
+				p = xconn.NewFinalProgress()
+			}
+			if first {
+				first = false
+				p.Kwargs = mergeKwargs(p.Kwargs, kwargs)
+				p.Kwargs["window"] = shellClientWindow
+				p.Kwargs["compression"] = shellEncoding
+				return p
+			}
+
+			select {
+			case <-announced:
+			case <-stop:
+			case <-time.After(shellIDWait):
+				announce.Do(func() { close(announced) })
+			}
+			if shellID != "" {
+				p.Kwargs = mergeKwargs(p.Kwargs, map[string]any{"id": shellID})
 			}
 			return p
 		}).
 		ProgressReceiver(func(result *xconn.ProgressResult) {
-			if len(result.Args()) > 0 {
-				_, err = os.Stdout.Write(result.Args()[0].([]byte))
-			} else {
-				_ = term.Restore(fd, oldState)
-				os.Exit(0)
+			if id, err := result.KwargString("id"); err == nil {
+				announce.Do(func() {
+					shellID = id
+					close(announced)
+				})
+			}
+			if result.ArgsLen() == 0 {
+				status = result
+				finish()
+				return
+			}
+			chunk, err := result.ArgBytes(0)
+			if err == nil && result.KwargStringOr("encoding", "") == shellEncoding {
+				chunk, err = inflate(chunk)
+			}
+			if err != nil {
+				return
+			}
+			_, _ = os.Stdout.Write(chunk)
+
+			// Acknowledge output in steps, well before the window runs out.
+			consumed += len(chunk)
+			if consumed >= shellClientWindow/4 {
+				select {
+				case progressChan <- newAckFrame(consumed):
+					consumed = 0
+				case <-stop:
+				}
 			}
 		}).Do()
 
-	if call.Err != nil {
+	// Once the shell has ended, a late failure of the call changes nothing.
+	if call.Err != nil && status == nil {
+		select {
+		case <-announced:
+			if shellID != "" {
+				return fmt.Errorf("shell error: %w (resume with --resume %s)", call.Err, shellID)
+			}
+		default:
+		}
 		return fmt.Errorf("shell error: %w", call.Err)
 	}
-	return nil
+
+	return shellEndError(status, shellID)
+}
+
+// shellEndError turns the message that ended a shell session into an error,
+// nil if the shell exited successfully.
+func shellEndError(status *xconn.ProgressResult, shellID string) error {
+	if status == nil {
+		return nil
+	}
+
+	switch reason := status.KwargStringOr("reason", ""); reason {
+	case "":
+	case "detached":
+		return fmt.Errorf("shell %s detached (resume with --resume %s)", shellID, shellID)
+	default:
+		return fmt.Errorf("shell %s closed: %s", shellID, strings.ReplaceAll(reason, "_", " "))
+	}
+
+	code := status.KwargInt64Or("exit_code", 0)
+	if code == 0 {
+		return nil
+	}
+	return &ShellExitError{Code: int(code), Signal: status.KwargStringOr("signal", "")}
 }
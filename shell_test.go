@@ -0,0 +1,758 @@
+package deskconn_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xconnio/deskconn"
+	"github.com/xconnio/xconn-go"
+)
+
+// setupShellDesktop registers the procedures of a desktop with the given shell
+// configuration and returns a session to call them.
+// quietShell starts shells that write nothing but the output of the commands
+// typed into them, given an empty prompt. Tests in which a caller leaves wait
+// for that output first: the in-memory router stops reading from the desktop
+// when it routes a result to a caller that has just left.
+var quietShell = deskconn.ShellConfig{Command: "/bin/sh", AllowedEnv: []string{"PS1"}}
+
+func setupShellDesktop(t testing.TB, config deskconn.ShellConfig) *xconn.Session {
+	t.Setenv("HOME", t.TempDir())
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(config)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	return caller
+}
+
+type remoteShell struct {
+	id     string
+	input  chan *xconn.Progress
+	output chan []byte
+	ended  chan struct{}
+	// status holds the kwargs of the message that ended the session.
+	status map[string]any
+	seen   strings.Builder
+	// compressed counts the chunks that arrived compressed.
+	compressed atomic.Int64
+}
+
+func openShell(t *testing.T, session *xconn.Session, procedure string, first *xconn.Progress) *remoteShell {
+	sh := &remoteShell{
+		input:  make(chan *xconn.Progress, 8),
+		output: make(chan []byte, 1024),
+		ended:  make(chan struct{}),
+	}
+	ids := make(chan string, 1)
+	sh.input <- first
+
+	go session.Call(procedure).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			return <-sh.input
+		}).
+		ProgressReceiver(func(result *xconn.ProgressResult) {
+			if id, err := result.KwargString("id"); err == nil {
+				select {
+				case ids <- id:
+				default:
+				}
+			}
+			if result.ArgsLen() == 0 {
+				sh.status = result.Kwargs()
+				close(sh.ended)
+				return
+			}
+			chunk := result.ArgBytesOr(0, nil)
+			if result.KwargStringOr("encoding", "") == "deflate" {
+				sh.compressed.Add(1)
+				chunk, _ = io.ReadAll(flate.NewReader(bytes.NewReader(chunk)))
+			}
+			sh.output <- chunk
+		}).Do()
+
+	select {
+	case sh.id = <-ids:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell id was not announced")
+	}
+
+	t.Cleanup(func() {
+		final := xconn.NewFinalProgress()
+		final.Kwargs = map[string]any{"id": sh.id}
+		sh.input <- final
+	})
+	return sh
+}
+
+func (s *remoteShell) send(data string) {
+	progress := xconn.NewProgress([]byte(data))
+	progress.Kwargs = map[string]any{"id": s.id}
+	s.input <- progress
+}
+
+func (s *remoteShell) sendFrame(frame string, kwargs map[string]any, args ...any) {
+	progress := xconn.NewProgress(args...)
+	progress.Kwargs = map[string]any{"id": s.id, "frame": frame, "version": 1}
+	for name, value := range kwargs {
+		progress.Kwargs[name] = value
+	}
+	s.input <- progress
+}
+
+func (s *remoteShell) waitFor(t *testing.T, text string) {
+	timeout := time.After(5 * time.Second)
+	for !strings.Contains(s.seen.String(), text) {
+		select {
+		case chunk := <-s.output:
+			s.seen.Write(chunk)
+		case <-timeout:
+			t.Fatalf("%q not seen in shell output %q", text, s.seen.String())
+		}
+	}
+}
+
+func (s *remoteShell) waitEnded(t *testing.T) {
+	select {
+	case <-s.ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell session did not end")
+	}
+}
+
+// listShells returns the running shells, mapped to whether a client is
+// attached to them.
+func listShells(t *testing.T, session *xconn.Session) map[string]bool {
+	response := session.Call(deskconn.ProcedureShellList).Do()
+	require.NoError(t, response.Err)
+
+	shells := make(map[string]bool, len(response.Args()))
+	for i := range response.Args() {
+		info, err := response.ArgDict(i)
+		require.NoError(t, err)
+		id, err := info.String("id")
+		require.NoError(t, err)
+		shells[id] = info.BoolOr("attached", false)
+	}
+	return shells
+}
+
+// rejectedShell opens a shell call that the desktop is expected to refuse,
+// returning the error it ends with.
+func rejectedShell(t *testing.T, session *xconn.Session, procedure string, first *xconn.Progress) error {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	sent := false
+	response := session.Call(procedure).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			if !sent {
+				sent = true
+				return first
+			}
+			<-done
+			return &xconn.Progress{Err: context.Canceled}
+		}).
+		ProgressReceiver(func(*xconn.ProgressResult) {}).
+		Do()
+	return response.Err
+}
+
+func shellProgress(kwargs map[string]any) *xconn.Progress {
+	progress := xconn.NewProgress([]byte("SIZE:80:24"))
+	progress.Kwargs = kwargs
+	return progress
+}
+
+func attachProgress(id string) *xconn.Progress {
+	return shellProgress(map[string]any{"id": id})
+}
+
+func TestShellSessions(t *testing.T) {
+	// Keep the user's startup files out of the spawned shells.
+	t.Setenv("HOME", t.TempDir())
+	r := setupRouter(t)
+	callee, err := xconn.ConnectInMemory(r, "realm1")
+	require.NoError(t, err)
+	caller := connectAs(t, r, "alice")
+	intruder := connectAs(t, r, "mallory")
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	first := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+	second := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+	require.NotEqual(t, first.id, second.id)
+	require.Equal(t, map[string]bool{first.id: true, second.id: true}, listShells(t, caller))
+
+	first.send("echo first-$((1+1))\n")
+	second.send("echo second-$((2+2))\n")
+	first.waitFor(t, "first-2")
+	second.waitFor(t, "second-4")
+	require.NotContains(t, first.seen.String(), "second")
+
+	t.Run("Attach", func(t *testing.T) {
+		attached := openShell(t, caller, deskconn.ProcedureShellAttach, attachProgress(first.id))
+		require.Equal(t, first.id, attached.id)
+		first.waitEnded(t)
+
+		attached.send("echo attached-$((2+3))\n")
+		attached.waitFor(t, "attached-5")
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		require.Empty(t, listShells(t, intruder))
+
+		err := rejectedShell(t, intruder, deskconn.ProcedureShellAttach, attachProgress(second.id))
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+
+		// Input for a shell of another user is dropped.
+		own := openShell(t, intruder, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+		require.Equal(t, map[string]bool{own.id: true}, listShells(t, intruder))
+		progress := xconn.NewProgress([]byte("echo hijacked-$((1+1))\n"))
+		progress.Kwargs = map[string]any{"id": second.id}
+		own.input <- progress
+		second.send("echo owner-$((2+1))\n")
+		second.waitFor(t, "owner-3")
+		require.NotContains(t, second.seen.String(), "hijacked-2")
+
+		response := intruder.Call(deskconn.ProcedureShellKill).Kwarg("id", second.id).Do()
+		require.ErrorContains(t, response.Err, deskconn.ErrNotAuthorized)
+		require.Contains(t, listShells(t, caller), second.id)
+	})
+
+	t.Run("Kill", func(t *testing.T) {
+		response := caller.Call(deskconn.ProcedureShellKill).Kwarg("id", second.id).Do()
+		require.NoError(t, response.Err)
+		second.waitEnded(t)
+
+		require.Eventually(t, func() bool {
+			_, running := listShells(t, caller)[second.id]
+			return !running
+		}, 5*time.Second, 50*time.Millisecond)
+
+		response = caller.Call(deskconn.ProcedureShellKill).Kwarg("id", second.id).Do()
+		require.ErrorContains(t, response.Err, deskconn.ErrInvalidArgument)
+	})
+}
+
+func TestShellResume(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	r := setupRouter(t)
+	callee, err := xconn.ConnectInMemory(r, "realm1")
+	require.NoError(t, err)
+	// The same user resumes the shell from another client.
+	caller := connectAs(t, r, "alice")
+	other := connectAs(t, r, "alice")
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(quietShell)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	sh := openShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+		"env": map[string]any{"PS1": ""},
+	}))
+	sh.send("echo before-$((3+4))\n")
+	sh.waitFor(t, "before-7")
+
+	require.NoError(t, caller.Leave())
+	require.Eventually(t, func() bool {
+		attached, running := listShells(t, other)[sh.id]
+		return running && !attached
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resumed := openShell(t, other, deskconn.ProcedureShellAttach, attachProgress(sh.id))
+	resumed.waitFor(t, "before-7")
+
+	resumed.send("echo after-$((4+4))\n")
+	resumed.waitFor(t, "after-8")
+}
+
+func TestShellGracePeriod(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	r := setupRouter(t)
+	callee, err := xconn.ConnectInMemory(r, "realm1")
+	require.NoError(t, err)
+	caller := connectAs(t, r, "alice")
+	other := connectAs(t, r, "alice")
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(quietShell)
+	d.SetShellGracePeriod(100 * time.Millisecond)
+	require.NoError(t, d.RegisterLocal(callee))
+
+	sh := openShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+		"env": map[string]any{"PS1": ""},
+	}))
+	sh.send("echo before-$((3+4))\n")
+	sh.waitFor(t, "before-7")
+	require.Contains(t, listShells(t, other), sh.id)
+
+	require.NoError(t, caller.Leave())
+	require.Eventually(t, func() bool {
+		return len(listShells(t, other)) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestShellConfig(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	configuredDir, requestedDir := t.TempDir(), t.TempDir()
+	d.SetShellConfig(deskconn.ShellConfig{
+		Command:         "/bin/sh",
+		Dir:             configuredDir,
+		Env:             []string{"DESKCONN_CONFIGURED=yes"},
+		AllowedCommands: []string{"/bin/bash"},
+		AllowedEnv:      []string{"DESKCONN_EXTRA"},
+		AllowedDirs:     []string{requestedDir},
+	})
+	require.NoError(t, d.RegisterLocal(callee))
+
+	t.Run("Defaults", func(t *testing.T) {
+		sh := openShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"env": map[string]any{"DESKCONN_EXTRA": "value", "DESKCONN_IGNORED": "value", "TERM": "vt100"},
+		}))
+		sh.send("echo \"$0:$DESKCONN_CONFIGURED:$DESKCONN_EXTRA:$DESKCONN_IGNORED:$TERM:$(pwd)\"\n")
+		sh.waitFor(t, "/bin/sh:yes:value::vt100:"+configuredDir)
+	})
+
+	t.Run("AllowedCommand", func(t *testing.T) {
+		sh := openShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"command": "/bin/bash",
+			"cwd":     requestedDir,
+		}))
+		sh.send("echo \"bash=${BASH_VERSION:+yes}:$(pwd)\"\n")
+		sh.waitFor(t, "bash=yes:"+requestedDir)
+	})
+
+	t.Run("DeniedCommand", func(t *testing.T) {
+		err := rejectedShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{"command": "/usr/bin/env"}))
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+
+		// The default command is not allowed unless it is listed.
+		err = rejectedShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{"command": "/bin/sh"}))
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+	})
+
+	t.Run("DeniedDir", func(t *testing.T) {
+		err := rejectedShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{"cwd": "/"}))
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+
+		err = rejectedShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"cwd": filepath.Join(requestedDir, ".."),
+		}))
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+	})
+}
+
+func TestShellFrames(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(deskconn.ShellConfig{Command: "/bin/sh"})
+	require.NoError(t, d.RegisterLocal(callee))
+
+	resize := xconn.NewProgress()
+	resize.Kwargs = map[string]any{"frame": "resize", "version": 1, "cols": 100, "rows": 40}
+	sh := openShell(t, caller, deskconn.ProcedureShell, resize)
+
+	t.Run("Resize", func(t *testing.T) {
+		sh.sendFrame("data", nil, []byte("stty size\n"))
+		sh.waitFor(t, "40 100")
+	})
+
+	t.Run("Data", func(t *testing.T) {
+		// Framed input starting with SIZE: is typed, not taken for a resize.
+		sh.sendFrame("data", nil, []byte("read line; echo got-$((1+1))=$line\n"))
+		sh.waitFor(t, "read line")
+		sh.sendFrame("data", nil, []byte("SIZE:9:9\n"))
+		sh.waitFor(t, "got-2=SIZE:9:9")
+	})
+
+	t.Run("Signal", func(t *testing.T) {
+		sh.sendFrame("data", nil, []byte(
+			"sh -c 'trap \"echo trapped-$((6*7)); exit\" INT; echo ready-$((1+1)); while :; do sleep 0.1; done'\n"))
+		sh.waitFor(t, "ready-2")
+		sh.sendFrame("signal", map[string]any{"signal": "SIGINT"})
+		sh.waitFor(t, "trapped-42")
+	})
+
+	t.Run("EOF", func(t *testing.T) {
+		sh.sendFrame("data", nil, []byte("echo reading-$((2+2)); cat; echo cat-done-$((2*3))\n"))
+		sh.waitFor(t, "reading-4")
+		sh.sendFrame("eof", nil)
+		sh.waitFor(t, "cat-done-6")
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		legacy := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:90:30")))
+		legacy.send("stty size\n")
+		legacy.waitFor(t, "30 90")
+	})
+
+	t.Run("UnknownFrame", func(t *testing.T) {
+		err := rejectedShell(t, caller, deskconn.ProcedureShell,
+			shellProgress(map[string]any{"frame": "bogus", "version": 1}))
+		require.ErrorContains(t, err, deskconn.ErrInvalidArgument)
+	})
+}
+
+func TestShellExitStatus(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(deskconn.ShellConfig{Command: "/bin/sh"})
+	require.NoError(t, d.RegisterLocal(callee))
+
+	t.Run("Exit", func(t *testing.T) {
+		sh := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+		sh.send("exit 7\n")
+		sh.waitEnded(t)
+		require.EqualValues(t, 7, sh.status["exit_code"])
+	})
+
+	t.Run("Killed", func(t *testing.T) {
+		sh := openShell(t, caller, deskconn.ProcedureShell, xconn.NewProgress([]byte("SIZE:80:24")))
+		response := caller.Call(deskconn.ProcedureShellKill).Kwarg("id", sh.id).Do()
+		require.NoError(t, response.Err)
+		sh.waitEnded(t)
+		require.EqualValues(t, 128+int(syscall.SIGHUP), sh.status["exit_code"])
+		require.Equal(t, syscall.SIGHUP.String(), sh.status["signal"])
+	})
+
+	// runShell drives the interactive client through a PTY standing in for
+	// the user's terminal.
+	runShell := func(t *testing.T, input string) error {
+		ptmx, tty, err := pty.Open()
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = ptmx.Close()
+			_ = tty.Close()
+		})
+		go func() { _, _ = io.Copy(io.Discard, ptmx) }()
+
+		stdin, stdout := os.Stdin, os.Stdout
+		os.Stdin, os.Stdout = tty, tty
+		t.Cleanup(func() { os.Stdin, os.Stdout = stdin, stdout })
+
+		done := make(chan error, 1)
+		go func() {
+			done <- deskconn.StartInteractiveShellWithOptions(caller, deskconn.ProcedureShell,
+				deskconn.ShellOptions{Env: map[string]string{"PS1": ""}})
+		}()
+		_, err = ptmx.Write([]byte(input))
+		require.NoError(t, err)
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("interactive shell did not return")
+			return nil
+		}
+	}
+
+	t.Run("ClientSuccess", func(t *testing.T) {
+		require.NoError(t, runShell(t, "exit 0\r"))
+	})
+
+	t.Run("ClientFailure", func(t *testing.T) {
+		err := runShell(t, "exit 3\r")
+		var exitErr *deskconn.ShellExitError
+		require.ErrorAs(t, err, &exitErr)
+		require.Equal(t, 3, exitErr.Code)
+	})
+}
+
+func TestShellLimits(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	callee, caller := setupRouterAndConnectSessions(t)
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(deskconn.ShellConfig{Command: "/bin/sh"})
+	require.NoError(t, d.RegisterLocal(callee))
+
+	t.Run("IdleTimeout", func(t *testing.T) {
+		d.SetShellLimits(400*time.Millisecond, 0)
+		sh := openShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"env": map[string]any{"PS1": ""},
+		}))
+
+		// Input keeps the shell alive past the timeout.
+		for i := 0; i < 4; i++ {
+			time.Sleep(150 * time.Millisecond)
+			sh.send("\n")
+		}
+		select {
+		case <-sh.ended:
+			t.Fatal("active shell was closed")
+		default:
+		}
+
+		sh.waitFor(t, "has been idle")
+		sh.waitEnded(t)
+		require.Equal(t, "idle_timeout", sh.status["reason"])
+	})
+
+	t.Run("MaxLifetime", func(t *testing.T) {
+		d.SetShellLimits(0, 400*time.Millisecond)
+		sh := openShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"env": map[string]any{"PS1": ""},
+		}))
+		sh.send("echo started-$((1+2))\n")
+		sh.waitFor(t, "started-3")
+
+		sh.waitFor(t, "maximum lifetime")
+		sh.waitEnded(t)
+		require.Equal(t, "max_lifetime", sh.status["reason"])
+	})
+}
+
+func TestShellWatch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	r := setupRouter(t)
+	callee, err := xconn.ConnectInMemory(r, "realm1")
+	require.NoError(t, err)
+	owner := connectAs(t, r, "alice")
+	observer := connectAs(t, r, "bob")
+
+	address := startPrivateBus(t)
+	screen := deskconn.NewScreen(connectPrivateBus(t, address), connectPrivateBus(t, address))
+	d := deskconn.NewDeskconn(screen)
+	d.SetShellConfig(deskconn.ShellConfig{Command: "/bin/sh"})
+	require.NoError(t, d.RegisterLocal(callee))
+
+	watchProgress := func(id string, write bool) *xconn.Progress {
+		progress := xconn.NewProgress()
+		progress.Kwargs = map[string]any{"id": id, "write": write}
+		return progress
+	}
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		sh := openShell(t, owner, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"env": map[string]any{"PS1": ""},
+		}))
+		sh.send("echo before-$((1+1))\n")
+		sh.waitFor(t, "before-2")
+
+		watching := openShell(t, observer, deskconn.ProcedureShellWatch, watchProgress(sh.id, false))
+		require.Equal(t, sh.id, watching.id)
+		watching.waitFor(t, "before-2")
+		sh.waitFor(t, "is now watching")
+
+		watching.send("echo ignored-$((2+3))\n")
+		sh.send("echo shared-$((2*4))\n")
+		sh.waitFor(t, "shared-8")
+		watching.waitFor(t, "shared-8")
+		require.NotContains(t, sh.seen.String(), "ignored")
+
+		err := rejectedShell(t, observer, deskconn.ProcedureShellWatch, watchProgress(sh.id, true))
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+	})
+
+	t.Run("ReadWrite", func(t *testing.T) {
+		sh := openShell(t, owner, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"env":         map[string]any{"PS1": ""},
+			"share_write": true,
+		}))
+		watching := openShell(t, observer, deskconn.ProcedureShellWatch, watchProgress(sh.id, true))
+		sh.waitFor(t, "is now watching")
+
+		watching.send("echo typed-$((5+5))\n")
+		sh.waitFor(t, "typed-10")
+		watching.waitFor(t, "typed-10")
+
+		sh.send("exit 4\n")
+		sh.waitEnded(t)
+		watching.waitEnded(t)
+		require.EqualValues(t, 4, watching.status["exit_code"])
+	})
+
+	t.Run("Lagging", func(t *testing.T) {
+		sh := openShell(t, owner, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"env": map[string]any{"PS1": ""},
+		}))
+		progress := watchProgress(sh.id, false)
+		progress.Kwargs["window"] = 16 * 1024
+		watching := openShell(t, observer, deskconn.ProcedureShellWatch, progress)
+
+		// The watcher never acknowledges its output, which must not stall
+		// the shell for its owner.
+		sh.send("yes deskconn | head -c 1000000; echo done-$((1+1))\n")
+		sh.waitFor(t, "done-2")
+		watching.waitEnded(t)
+		require.Equal(t, "lagging", watching.status["reason"])
+		for len(watching.output) > 0 {
+			watching.seen.Write(<-watching.output)
+		}
+		require.Less(t, watching.seen.Len(), 200_000)
+	})
+
+	t.Run("TakeOver", func(t *testing.T) {
+		sh := openShell(t, owner, deskconn.ProcedureShell, shellProgress(map[string]any{
+			"env": map[string]any{"PS1": ""},
+		}))
+
+		// A watcher refused input cannot gain it by attaching to the shell or
+		// end it instead.
+		err := rejectedShell(t, observer, deskconn.ProcedureShellWatch, watchProgress(sh.id, true))
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+
+		attach := xconn.NewProgress()
+		attach.Kwargs = map[string]any{"id": sh.id}
+		err = rejectedShell(t, observer, deskconn.ProcedureShellAttach, attach)
+		require.ErrorContains(t, err, deskconn.ErrNotAuthorized)
+
+		response := observer.Call(deskconn.ProcedureShellKill).Kwarg("id", sh.id).Do()
+		require.ErrorContains(t, response.Err, deskconn.ErrNotAuthorized)
+
+		sh.send("echo still-$((3*3))\n")
+		sh.waitFor(t, "still-9")
+	})
+}
+
+func TestShellFlowControl(t *testing.T) {
+	caller := setupShellDesktop(t, deskconn.ShellConfig{Command: "/bin/sh"})
+
+	const window = 16 * 1024
+	sh := openShell(t, caller, deskconn.ProcedureShell, shellProgress(map[string]any{
+		"env":         map[string]any{"PS1": ""},
+		"window":      window,
+		"compression": "deflate",
+	}))
+	sh.send("yes deskconn | head -c 1000000; echo done-$((1+1))\n")
+
+	// Without acknowledgements the desktop stops once the window is used up.
+	received := 0
+	timeout := time.After(300 * time.Millisecond)
+waiting:
+	for {
+		select {
+		case chunk := <-sh.output:
+			received += len(chunk)
+			sh.seen.Write(chunk)
+		case <-timeout:
+			break waiting
+		}
+	}
+	require.Less(t, received, 200_000)
+	require.NotContains(t, sh.seen.String(), "done-2")
+
+	sh.sendFrame("ack", map[string]any{"bytes": received})
+	deadline := time.After(10 * time.Second)
+	for !strings.Contains(sh.seen.String(), "done-2") {
+		select {
+		case chunk := <-sh.output:
+			received += len(chunk)
+			sh.seen.Write(chunk)
+			sh.sendFrame("ack", map[string]any{"bytes": len(chunk)})
+		case <-deadline:
+			t.Fatalf("output stalled after %d bytes", received)
+		}
+	}
+	require.Greater(t, received, 1_000_000)
+	require.Positive(t, sh.compressed.Load())
+}
+
+// BenchmarkShellOutput measures streaming the output of a program that writes
+// in bulk, without and with the send window and compression.
+func BenchmarkShellOutput(b *testing.B) {
+	const size = 3 * 1024 * 1024
+	caller := setupShellDesktop(b, deskconn.ShellConfig{Command: "/bin/sh"})
+
+	for _, mode := range []struct {
+		name   string
+		kwargs map[string]any
+	}{
+		{name: "Unacknowledged"},
+		{name: "Windowed", kwargs: map[string]any{"window": 256 * 1024, "compression": "deflate"}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			b.SetBytes(size * 4 / 3)
+			messages := 0
+			for i := 0; i < b.N; i++ {
+				messages += streamShellOutput(b, caller, size, mode.kwargs)
+			}
+			b.ReportMetric(float64(messages)/float64(b.N), "msgs/op")
+		})
+	}
+}
+
+// streamShellOutput runs a shell printing size random bytes in base64 and
+// returns how many messages its output took.
+func streamShellOutput(b *testing.B, session *xconn.Session, size int, kwargs map[string]any) int {
+	first := xconn.NewProgress()
+	first.Kwargs = map[string]any{"args": []any{"-c", fmt.Sprintf("head -c %d /dev/urandom | base64", size)}}
+	for name, value := range kwargs {
+		first.Kwargs[name] = value
+	}
+
+	input := make(chan *xconn.Progress, 64)
+	input <- first
+	var id string
+	messages := 0
+
+	response := session.Call(deskconn.ProcedureShell).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			return <-input
+		}).
+		ProgressReceiver(func(result *xconn.ProgressResult) {
+			if announced, err := result.KwargString("id"); err == nil {
+				id = announced
+			}
+			if result.ArgsLen() == 0 {
+				final := xconn.NewFinalProgress()
+				final.Kwargs = map[string]any{"id": id}
+				input <- final
+				return
+			}
+
+			messages++
+			chunk := result.ArgBytesOr(0, nil)
+			if result.KwargStringOr("encoding", "") == "deflate" {
+				chunk, _ = io.ReadAll(flate.NewReader(bytes.NewReader(chunk)))
+			}
+			if kwargs["window"] != nil {
+				ack := xconn.NewProgress()
+				ack.Kwargs = map[string]any{"id": id, "frame": "ack", "version": 1, "bytes": len(chunk)}
+				input <- ack
+			}
+		}).Do()
+	require.NoError(b, response.Err)
+
+	return messages
+}
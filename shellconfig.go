@@ -0,0 +1,234 @@
+package deskconn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	fallbackShell    = "/bin/sh"
+	defaultShellTerm = "xterm-256color"
+)
+
+// callerEnv are the environment variables every caller may set, which
+// clients send to match the shell to their terminal.
+var callerEnv = []string{"TERM", "LANG"}
+
+var (
+	errShellCommandNotAllowed = errors.New("shell command not allowed")
+	errShellDirNotAllowed     = errors.New("shell directory not allowed")
+)
+
+// ShellConfig controls the shells deskconnd starts. Callers may choose among
+// the allowed commands, directories and environment variables.
+type ShellConfig struct {
+	// Command is started when the caller does not ask for one; empty means
+	// $SHELL, falling back to /bin/sh.
+	Command string
+	// Login starts every shell as a login shell.
+	Login bool
+	// Dir is the starting directory; empty means the home directory of User,
+	// or deskconnd's own working directory.
+	Dir string
+	// Env holds extra KEY=value variables added to deskconnd's environment.
+	Env []string
+	// User runs shells as another local user, which requires deskconnd to
+	// have the privileges to switch to it.
+	User string
+	// AllowedCommands lists the programs callers may request. When set, it
+	// also limits the commands run through exec, Command included.
+	AllowedCommands []string
+	// AllowedEnv names the environment variables callers may set besides
+	// TERM and LANG; others they send are ignored.
+	AllowedEnv []string
+	// AllowedDirs lists the directories callers may start in, along with
+	// the directories below them.
+	AllowedDirs []string
+}
+
+// ShellOptions are the choices a client makes when starting a shell. Unset
+// fields keep the defaults configured on the desktop.
+type ShellOptions struct {
+	Command string
+	Args    []string
+	Login   bool
+	Dir     string
+	Env     map[string]string
+	// ShareWrite lets watchers of the shell ask to type into it.
+	ShareWrite bool
+}
+
+func (o ShellOptions) kwargs() map[string]any {
+	kwargs := map[string]any{}
+	if o.Command != "" {
+		kwargs["command"] = o.Command
+	}
+	if len(o.Args) > 0 {
+		kwargs["args"] = o.Args
+	}
+	if o.Login {
+		kwargs["login"] = true
+	}
+	if o.Dir != "" {
+		kwargs["cwd"] = o.Dir
+	}
+	if o.ShareWrite {
+		kwargs["share_write"] = true
+	}
+
+	env := map[string]any{}
+	for _, name := range []string{"TERM", "LANG"} {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+	for name, value := range o.Env {
+		env[name] = value
+	}
+	if len(env) > 0 {
+		kwargs["env"] = env
+	}
+
+	return kwargs
+}
+
+func (c ShellConfig) defaultCommand() string {
+	if c.Command != "" {
+		return c.Command
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	return fallbackShell
+}
+
+// command builds the shell requested by an invocation, checking it against
+// the allowed commands. Without an allow-list only the default command may be
+// requested.
+func (c ShellConfig) command(inv *xconn.Invocation) (*exec.Cmd, error) {
+	command := c.defaultCommand()
+	if requested, err := inv.KwargString("command"); err == nil {
+		if len(c.AllowedCommands) == 0 && requested != command ||
+			len(c.AllowedCommands) > 0 && !slices.Contains(c.AllowedCommands, requested) {
+			return nil, fmt.Errorf("%w: %s", errShellCommandNotAllowed, requested)
+		}
+		command = requested
+	}
+
+	var args []string
+	if c.Login || inv.KwargBoolOr("login", false) {
+		args = append(args, "-l")
+	}
+	for _, arg := range inv.KwargListOr("args", nil) {
+		value, err := arg.String()
+		if err != nil {
+			return nil, fmt.Errorf("shell arguments must be strings")
+		}
+		args = append(args, value)
+	}
+
+	cmd := exec.Command(command, args...) // #nosec G204
+	cmd.Env = append(os.Environ(), "TERM="+defaultShellTerm)
+	if err := c.prepare(cmd, inv); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// allowsExec reports whether a command may be run through exec. Without an
+// allow-list any command may, as shells can run them anyway.
+func (c ShellConfig) allowsExec(command string) bool {
+	return len(c.AllowedCommands) == 0 || slices.Contains(c.AllowedCommands, command)
+}
+
+// allowsDir reports whether callers may start in a directory. Symlinks are
+// resolved so they cannot lead out of the allowed directories.
+func (c ShellConfig) allowsDir(dir string) bool {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range c.AllowedDirs {
+		allowed, err := filepath.EvalSymlinks(allowed)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(allowed, resolved); err == nil && filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare applies the configured user, directory and environment to a
+// command, followed by the ones the invocation asks for as far as they are
+// allowed.
+func (c ShellConfig) prepare(cmd *exec.Cmd, inv *xconn.Invocation) error {
+	cmd.Dir = c.Dir
+
+	if c.User != "" {
+		if err := runAs(cmd, c.User); err != nil {
+			return err
+		}
+	}
+
+	cmd.Env = append(cmd.Env, c.Env...)
+	for name, value := range inv.KwargDictOr("env", nil) {
+		if !slices.Contains(callerEnv, name) && !slices.Contains(c.AllowedEnv, name) {
+			continue
+		}
+		text, err := value.String()
+		if err != nil {
+			return fmt.Errorf("environment variable %s must be a string", name)
+		}
+		cmd.Env = append(cmd.Env, name+"="+text)
+	}
+
+	if dir, err := inv.KwargString("cwd"); err == nil {
+		if !c.allowsDir(dir) {
+			return fmt.Errorf("%w: %s", errShellDirNotAllowed, dir)
+		}
+		cmd.Dir = dir
+	}
+
+	return nil
+}
+
+// runAs switches the command to another user, starting in their home
+// directory unless a directory was configured.
+func runAs(cmd *exec.Cmd, name string) error {
+	account, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("failed to look up shell user: %w", err)
+	}
+
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid for %s: %w", name, err)
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid gid for %s: %w", name, err)
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, // #nosec G115
+	}
+	cmd.Env = append(cmd.Env, "HOME="+account.HomeDir, "USER="+account.Username, "LOGNAME="+account.Username)
+	if cmd.Dir == "" {
+		cmd.Dir = account.HomeDir
+	}
+
+	return nil
+}
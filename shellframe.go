@@ -0,0 +1,170 @@
+package deskconn
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"syscall"
+
+	"github.com/creack/pty"
+
+	"github.com/xconnio/xconn-go"
+)
+
+// Progressive shell messages are framed by their kwargs: "frame" names the
+// kind of message and "version" the framing it follows. Data frames carry
+// terminal input in the first argument, resize frames "cols" and "rows",
+// signal frames the "signal" name and ack frames the "bytes" of output the
+// client consumed since its last ack. Messages without a frame come from older
+// clients, which send input as is and resizes as "SIZE:<cols>:<rows>".
+const (
+	shellFrameVersion = 1
+
+	shellFrameData   = "data"
+	shellFrameResize = "resize"
+	shellFrameSignal = "signal"
+	shellFrameEOF    = "eof"
+	shellFrameAck    = "ack"
+)
+
+// shellEOF is the end-of-file character of a terminal in canonical mode.
+const shellEOF = 0x04
+
+// shellSignals are the signals clients may send to a shell.
+var shellSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+type shellFrame struct {
+	kind    string
+	data    []byte
+	winsize *pty.Winsize
+	signal  syscall.Signal
+	acked   int64
+}
+
+// unknownShell answers a message for a shell that no longer exists. Output
+// can be acknowledged after the shell has exited, so those messages are
+// quietly dropped.
+func unknownShell(inv *xconn.Invocation, id string) *xconn.InvocationResult {
+	if inv.KwargStringOr("frame", "") == shellFrameAck {
+		return xconn.NewInvocationError(xconn.ErrNoResult)
+	}
+	if id == "" {
+		return xconn.NewInvocationError(ErrInvalidArgument, "unknown shell")
+	}
+	return xconn.NewInvocationError(ErrInvalidArgument, fmt.Sprintf("unknown shell %q", id))
+}
+
+func parseShellFrame(inv *xconn.Invocation) (*shellFrame, error) {
+	kind, err := inv.KwargString("frame")
+	if err != nil {
+		return parseLegacyShellFrame(inv)
+	}
+
+	if version := inv.KwargInt64Or("version", shellFrameVersion); version != shellFrameVersion {
+		return nil, fmt.Errorf("unsupported shell frame version %d", version)
+	}
+
+	frame := &shellFrame{kind: kind}
+	switch kind {
+	case shellFrameData:
+		if inv.ArgsLen() > 0 {
+			if frame.data, err = inv.ArgBytes(0); err != nil {
+				return nil, err
+			}
+		}
+	case shellFrameResize:
+		cols, err := inv.KwargInt64("cols")
+		if err != nil {
+			return nil, fmt.Errorf("resize frame requires cols")
+		}
+		rows, err := inv.KwargInt64("rows")
+		if err != nil {
+			return nil, fmt.Errorf("resize frame requires rows")
+		}
+		if frame.winsize, err = newWinsize(cols, rows); err != nil {
+			return nil, err
+		}
+	case shellFrameSignal:
+		name, err := inv.KwargString("signal")
+		if err != nil {
+			return nil, fmt.Errorf("signal frame requires signal")
+		}
+		signal, ok := shellSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported signal %q", name)
+		}
+		frame.signal = signal
+	case shellFrameEOF:
+	case shellFrameAck:
+		if frame.acked, err = inv.KwargInt64("bytes"); err != nil || frame.acked < 0 {
+			return nil, fmt.Errorf("ack frame requires bytes")
+		}
+	default:
+		return nil, fmt.Errorf("unknown shell frame %q", kind)
+	}
+
+	return frame, nil
+}
+
+func parseLegacyShellFrame(inv *xconn.Invocation) (*shellFrame, error) {
+	if inv.ArgsLen() == 0 {
+		return &shellFrame{kind: shellFrameData}, nil
+	}
+
+	payload, err := inv.ArgBytes(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(payload, []byte("SIZE:")) {
+		return &shellFrame{kind: shellFrameData, data: payload}, nil
+	}
+
+	// Malformed sizes were always swallowed rather than typed into the shell.
+	frame := &shellFrame{kind: shellFrameResize}
+	var cols, rows int64
+	if n, _ := fmt.Sscanf(string(payload), "SIZE:%d:%d", &cols, &rows); n == 2 {
+		if frame.winsize, err = newWinsize(cols, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	return frame, nil
+}
+
+func newWinsize(cols, rows int64) (*pty.Winsize, error) {
+	if cols < 0 || cols > math.MaxUint16 || rows < 0 || rows > math.MaxUint16 {
+		return nil, fmt.Errorf("invalid size")
+	}
+
+	return &pty.Winsize{
+		Cols: uint16(cols), // #nosec G115
+		Rows: uint16(rows), // #nosec G115
+	}, nil
+}
+
+func newDataFrame(data []byte) *xconn.Progress {
+	progress := xconn.NewProgress(data)
+	progress.Kwargs = map[string]any{"frame": shellFrameData, "version": shellFrameVersion}
+	return progress
+}
+
+func newAckFrame(n int) *xconn.Progress {
+	progress := xconn.NewProgress()
+	progress.Kwargs = map[string]any{"frame": shellFrameAck, "version": shellFrameVersion, "bytes": n}
+	return progress
+}
+
+func newResizeFrame(cols, rows int) *xconn.Progress {
+	progress := xconn.NewProgress()
+	progress.Kwargs = map[string]any{
+		"frame":   shellFrameResize,
+		"version": shellFrameVersion,
+		"cols":    cols,
+		"rows":    rows,
+	}
+	return progress
+}
@@ -0,0 +1,116 @@
+package deskconn
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// shellWarningLead is how long before closing a shell for a limit the
+	// terminal is warned, shortened for limits under twice as long.
+	shellWarningLead = time.Minute
+
+	shellReasonIdle     = "idle_timeout"
+	shellReasonLifetime = "max_lifetime"
+)
+
+func warningLead(limit time.Duration) time.Duration {
+	return min(shellWarningLead, limit/2)
+}
+
+// startLimits arms the idle timeout and maximum lifetime of a shell, either of
+// which is off when zero.
+func (s *shell) startLimits(idleTimeout, maxLifetime time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastActivity = time.Now()
+	s.idleTimeout = idleTimeout
+	if idleTimeout > 0 {
+		s.idleTimer = time.AfterFunc(idleTimeout-warningLead(idleTimeout), s.checkIdle)
+	}
+	if maxLifetime > 0 {
+		lead := warningLead(maxLifetime)
+		s.lifetimeTimer = time.AfterFunc(maxLifetime-lead, func() {
+			s.Lock()
+			defer s.Unlock()
+
+			if s.closed {
+				return
+			}
+			s.warn(fmt.Sprintf("This shell reached its maximum lifetime of %v and will be closed in %v.",
+				maxLifetime, lead))
+			s.lifetimeTimer = time.AfterFunc(lead, func() { s.terminate(shellReasonLifetime) })
+		})
+	}
+}
+
+// touch records input, which keeps the shell from going idle.
+func (s *shell) touch() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.touchLocked()
+}
+
+func (s *shell) touchLocked() {
+	s.lastActivity = time.Now()
+	s.idleWarned = false
+}
+
+// checkIdle warns about or closes a shell that has been idle long enough, and
+// otherwise checks again when it could next be.
+func (s *shell) checkIdle() {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
+	}
+
+	idle := time.Since(s.lastActivity)
+	lead := warningLead(s.idleTimeout)
+	switch {
+	case idle >= s.idleTimeout:
+		s.Unlock()
+		s.terminate(shellReasonIdle)
+		return
+	case idle >= s.idleTimeout-lead:
+		if !s.idleWarned {
+			s.idleWarned = true
+			s.warn(fmt.Sprintf("This shell has been idle for %v and will be closed in %v unless used.",
+				s.idleTimeout-lead, lead))
+		}
+		s.idleTimer.Reset(s.idleTimeout - idle)
+	default:
+		s.idleTimer.Reset(s.idleTimeout - lead - idle)
+	}
+	s.Unlock()
+}
+
+// warn writes a notice into the terminal of the client. It must be called
+// with the lock held.
+func (s *shell) warn(message string) {
+	s.emit([]byte("\r\n[deskconn] " + message + "\r\n"))
+}
+
+// terminate closes the shell for a limit, telling the client why once the
+// shell has exited.
+func (s *shell) terminate(reason string) {
+	s.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.Unlock()
+
+	_ = s.close()
+}
+
+// stopLimits must be called with the lock held.
+func (s *shell) stopLimits() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	if s.lifetimeTimer != nil {
+		s.lifetimeTimer.Stop()
+	}
+}
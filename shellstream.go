@@ -0,0 +1,153 @@
+package deskconn
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"time"
+
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	// shellReadSize is how much is read from a PTY at once.
+	shellReadSize = 4096
+	// shellReadQueue bounds how many reads wait to be sent. Once it is full
+	// the PTY is no longer read, which in turn blocks the programs writing to
+	// it.
+	shellReadQueue = 16
+	// shellBatchSize and shellBatchDelay bound how much output, and for how
+	// long, is collected into one message while a program writes in bulk.
+	shellBatchSize  = 64 * 1024
+	shellBatchDelay = 5 * time.Millisecond
+
+	// shellCompressMin is the smallest output compressed for clients that
+	// accept it; smaller messages gain too little.
+	shellCompressMin = 1024
+	shellEncoding    = "deflate"
+
+	// shellClientWindow is how many bytes of output the client lets the
+	// desktop send ahead of its acknowledgements.
+	shellClientWindow = 256 * 1024
+)
+
+// outputStream sends shell output to one client. Clients that announce a
+// window in their first message acknowledge the output they have consumed,
+// and no more than the window is sent ahead of them. Older clients get
+// output as fast as it is produced.
+type outputStream struct {
+	sink     xconn.SendProgress
+	window   int64
+	inflight int64
+	deflate  bool
+}
+
+func newOutputStream(inv *xconn.Invocation) *outputStream {
+	return &outputStream{
+		sink:    inv.SendProgress,
+		window:  max(inv.KwargInt64Or("window", 0), 0),
+		deflate: inv.KwargStringOr("compression", "") == shellEncoding,
+	}
+}
+
+// ready reports whether the client has room for more output. A chunk larger
+// than the whole window still goes out once everything before it is
+// acknowledged.
+func (o *outputStream) ready() bool {
+	return o.window == 0 || o.inflight < o.window
+}
+
+func (o *outputStream) ack(n int64) {
+	o.inflight = max(o.inflight-n, 0)
+}
+
+// send delivers a chunk of output, compressed if the client accepts it and
+// it is worth it. Chunks are compressed at most once for all clients.
+func (o *outputStream) send(chunk []byte, kwargs map[string]any, packed *[]byte) error {
+	o.inflight += int64(len(chunk))
+
+	if o.deflate && len(chunk) >= shellCompressMin {
+		if *packed == nil {
+			*packed = deflate(chunk)
+		}
+		if len(*packed) < len(chunk) {
+			return o.sink([]any{*packed}, mergeKwargs(map[string]any{"encoding": shellEncoding}, kwargs))
+		}
+	}
+
+	return o.sink([]any{chunk}, kwargs)
+}
+
+func deflate(data []byte) []byte {
+	var out bytes.Buffer
+	writer, _ := flate.NewWriter(&out, flate.BestSpeed)
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+	return out.Bytes()
+}
+
+func inflate(data []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+}
+
+// readOutput reads a PTY into a queue of chunks until it fails, closing the
+// queue.
+func readOutput(ptmx io.Reader, chunks chan<- []byte) {
+	defer close(chunks)
+	for {
+		buf := make([]byte, shellReadSize)
+		n, err := ptmx.Read(buf)
+		if n > 0 {
+			chunks <- buf[:n]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// batchOutput adds to a chunk the output that follows it, so that bulk output
+// goes out in fewer and larger messages. Output that is already queued is
+// always taken; after a full read, output that arrives within
+// shellBatchDelay is too. A short read with nothing behind it, such as the
+// echo of a keystroke, is sent at once.
+func batchOutput(first []byte, chunks <-chan []byte) []byte {
+	batch := first
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for len(batch) < shellBatchSize {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, chunk...)
+			continue
+		default:
+		}
+
+		if len(batch) < shellReadSize {
+			return batch
+		}
+		if timer == nil {
+			timer = time.NewTimer(shellBatchDelay)
+		}
+
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, chunk...)
+		case <-timer.C:
+			return batch
+		}
+	}
+
+	return batch
+}
@@ -0,0 +1,154 @@
+package deskconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/xconnio/xconn-go"
+)
+
+var errShellWriteNotShared = errors.New("shell does not accept input from watchers")
+
+// watcher is a call following a shell next to the attached one. Watchers see
+// the same output, and may type into the shell if the attached client lets
+// them.
+type watcher struct {
+	*outputStream
+	authID string
+	write  bool
+}
+
+// watch adds the call as a watcher of the shell, announcing the shell id
+// along with the scrollback, and returns the call it replaces, if the caller
+// was already watching.
+func (s *shell) watch(caller callerKey, authID string, stream *outputStream, write, replay bool) (
+	xconn.SendProgress, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ended {
+		return nil, errShellEnded
+	}
+	if write && !s.shareWrite {
+		return nil, fmt.Errorf("%w: %s", errShellWriteNotShared, s.id)
+	}
+
+	var previous xconn.SendProgress
+	if w, ok := s.watchers[caller]; ok {
+		previous = w.sink
+		delete(s.watchers, caller)
+	}
+
+	mode := "read-only"
+	if write {
+		mode = "read-write"
+	}
+	s.recorder.mark(fmt.Sprintf("watched by %s (%s)", authID, mode))
+	s.warn(fmt.Sprintf("%s is now watching this shell (%s).", authID, mode))
+
+	output := []byte{}
+	if replay {
+		output = s.scrollback.Bytes()
+	}
+	var packed []byte
+	if err := stream.send(output, map[string]any{"id": s.id}, &packed); err == nil {
+		s.watchers[caller] = &watcher{outputStream: stream, authID: authID, write: write}
+	}
+	s.drained.Broadcast()
+
+	return previous, nil
+}
+
+// unwatch stops sending output to a watcher, reporting whether the caller
+// was one.
+func (s *shell) unwatch(caller callerKey) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.unwatchLocked(caller)
+}
+
+func (s *shell) unwatchLocked(caller callerKey) bool {
+	w, ok := s.watchers[caller]
+	if !ok {
+		return false
+	}
+
+	delete(s.watchers, caller)
+	s.drained.Broadcast()
+	s.recorder.mark("no longer watched by " + w.authID)
+	return true
+}
+
+// shareInput lets watchers ask to type into the shell, or revokes it from
+// all of them.
+func (s *shell) shareInput(allow bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.shareWrite = allow
+	if !allow {
+		for _, w := range s.watchers {
+			w.write = false
+		}
+	}
+}
+
+// canWrite reports whether the caller may type into the shell as a watcher.
+func (s *shell) canWrite(caller callerKey) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	w, ok := s.watchers[caller]
+	return ok && w.write
+}
+
+func (p *interactiveShellSession) handleShellWatch() func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(ctx context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		id, err := inv.KwargString("id")
+		if err != nil {
+			return xconn.NewInvocationError(ErrInvalidArgument, "shell id is required")
+		}
+
+		caller := callerOf(ctx, inv)
+		sh := p.shell(id)
+		if !inv.Progress() {
+			if sh != nil {
+				sh.unwatch(caller)
+			}
+			return xconn.NewInvocationResult()
+		}
+		if sh == nil {
+			return unknownShell(inv, id)
+		}
+
+		if isNewCall(inv) {
+			previous, err := sh.watch(caller, inv.CallerAuthID(), newOutputStream(inv),
+				inv.KwargBoolOr("write", false), inv.KwargBoolOr("replay", true))
+			if errors.Is(err, errShellEnded) {
+				return unknownShell(inv, id)
+			}
+			if previous != nil {
+				_ = previous(nil, map[string]any{"reason": "detached"})
+			}
+			if err != nil {
+				return xconn.NewInvocationError(ErrNotAuthorized, err.Error())
+			}
+		}
+
+		frame, err := parseShellFrame(inv)
+		if err != nil {
+			return xconn.NewInvocationError(ErrInvalidArgument, err.Error())
+		}
+
+		// Input from read-only watchers is dropped, and the size of the
+		// terminal is left to the attached client.
+		if frame.kind != shellFrameAck && (frame.kind == shellFrameResize || !sh.canWrite(caller)) {
+			return xconn.NewInvocationError(xconn.ErrNoResult)
+		}
+
+		return p.apply(sh, caller, frame)
+	}
+}